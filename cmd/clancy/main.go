@@ -1,25 +1,70 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/alexflint/go-arg"
+	"github.com/eduardolat/clancy/internal/asciicast"
 	"github.com/eduardolat/clancy/internal/config"
+	"github.com/eduardolat/clancy/internal/events"
 	"github.com/eduardolat/clancy/internal/loop"
+	"github.com/eduardolat/clancy/internal/metrics"
 	"github.com/eduardolat/clancy/internal/runner"
+	"github.com/eduardolat/clancy/internal/runs"
+	"github.com/eduardolat/clancy/internal/server"
+	"github.com/eduardolat/clancy/internal/telemetry"
+	"github.com/eduardolat/clancy/internal/tui"
 	"github.com/eduardolat/clancy/internal/version"
 	gonanoid "github.com/matoous/go-nanoid/v2"
+	"go.opentelemetry.io/otel"
 )
 
+// Exit codes, so scripts and CI can tell apart why Clancy stopped.
+const (
+	exitFailure = 1 // Config errors, timeouts or max steps reached
+	exitAborted = 3 // The agent printed one of the abort phrases
+
+	exitInterrupted = 130 // Stopped by SIGINT/SIGTERM, as shells report Ctrl-C
+)
+
+// telemetryFlushTimeout bounds the export of the remaining spans on exit, an
+// unreachable collector must not hang Clancy.
+const telemetryFlushTimeout = 5 * time.Second
+
+// replayMaxIdle caps the pauses in a replay, agents can be silent for minutes.
+const replayMaxIdle = 2 * time.Second
+
 //go:embed template.yaml
 var templateContent []byte
 
+// OutputArgs defines the reporting and remote control options shared by
+// commands that run the loop.
+type OutputArgs struct {
+	Events     string `arg:"--events" help:"Emit events on stdout in this format (json), other output goes to stderr"`
+	EventsFile string `arg:"--events-file" help:"Append JSON events to this file"`
+	TUI        bool   `arg:"--tui" help:"Show a full-screen dashboard instead of the plain output"`
+	Listen     string `arg:"--listen" help:"Serve the HTTP status and control API on this address, e.g. 127.0.0.1:7777"`
+	Token      string `arg:"--token,env:CLANCY_TOKEN" help:"Bearer token required by the HTTP API"`
+}
+
 // Args defines command line arguments.
 type Args struct {
 	Config string `arg:"positional" default:"clancy.yaml" help:"Path to configuration file"`
 	New    bool   `arg:"--new" help:"Generate a new configuration file"`
+	OutputArgs
 }
 
 func (Args) Version() string {
@@ -28,12 +73,62 @@ func (Args) Version() string {
 }
 
 func (Args) Description() string {
-	return "Clancy - AI Agent Loop Orchestrator"
+	return "Clancy - AI Agent Loop Orchestrator\n\n" +
+		"Use 'clancy resume <run-id>' to continue an interrupted run and\n" +
+		"'clancy replay <run-id>' to watch a recorded one."
+}
+
+// ResumeArgs defines command line arguments for "clancy resume".
+type ResumeArgs struct {
+	ID    string `arg:"positional,required" help:"ID of the run to resume"`
+	Force bool   `arg:"--force" help:"Resume even if the config or prompt changed"`
+	OutputArgs
+}
+
+func (ResumeArgs) Description() string {
+	return "Continue an interrupted run from its next step, with the remaining timeout."
+}
+
+// ReplayArgs defines command line arguments for "clancy replay".
+type ReplayArgs struct {
+	ID    string `arg:"positional,required" help:"ID of the run to replay"`
+	Step  int    `arg:"--step" help:"Only replay this step"`
+	Speed Speed  `arg:"--speed" default:"1x" help:"Playback speed, e.g. 4x"`
+}
+
+func (ReplayArgs) Description() string {
+	return "Play back the recorded steps of a run (requires agent.record)."
+}
+
+// Speed is a playback speed written as "4x" or "4".
+type Speed float64
+
+func (s *Speed) UnmarshalText(text []byte) error {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(string(text)), "x"), 64)
+	if err != nil || v <= 0 {
+		return fmt.Errorf("invalid speed %q, use e.g. 2x", text)
+	}
+	*s = Speed(v)
+	return nil
 }
 
 func main() {
+	// go-arg cannot mix subcommands with the positional config path, so
+	// subcommands are dispatched by hand.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "resume":
+			resume(os.Args[2:])
+			return
+		case "replay":
+			replay(os.Args[2:])
+			return
+		}
+	}
+
 	var args Args
-	arg.MustParse(&args)
+	p := arg.MustParse(&args)
+	checkOutputArgs(p, args.OutputArgs)
 
 	// Handle --new flag
 	if args.New {
@@ -52,27 +147,355 @@ func main() {
 	}
 
 	// 2. Resolve Input Prompt
-	prompt, err := cfg.ResolvePrompt()
+	prompt, err := resolvePrompt(cfg)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error resolving prompt: %v\n", err)
 		os.Exit(1)
 	}
 
+	fp, err := newFingerprint(args.Config, cfg, prompt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	state := runs.State{ConfigPath: args.Config}
+	fp.save(&state)
+	run, err := runs.Create(runs.DefaultDir, state)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating run: %v\n", err)
+		os.Exit(1)
+	}
+
+	execute(cfg, args.Config, prompt, run, args.OutputArgs)
+}
+
+// resume continues a run persisted in runs.DefaultDir.
+func resume(argv []string) {
+	var args ResumeArgs
+	p, err := arg.NewParser(arg.Config{Program: "clancy resume"}, &args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	p.MustParse(argv)
+	checkOutputArgs(p, args.OutputArgs)
+
+	run, err := runs.Open(runs.DefaultDir, args.ID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if run.State.Status == runs.StatusSucceeded {
+		fmt.Fprintf(os.Stderr, "Error: run %s already succeeded, there is nothing to resume\n", args.ID)
+		os.Exit(1)
+	}
+
+	configPath := run.State.ConfigPath
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config file '%s': %v\n", configPath, err)
+		os.Exit(1)
+	}
+	prompt, err := resolvePrompt(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error resolving prompt: %v\n", err)
+		os.Exit(1)
+	}
+
+	fp, err := newFingerprint(configPath, cfg, prompt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkResume(run.State, fp, cfg.Input.Reload, args.Force); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v. Use --force to resume anyway.\n", err)
+		os.Exit(1)
+	}
+	fp.save(&run.State)
+
+	fmt.Fprintf(os.Stderr, ">>> [Clancy] Resuming run %s at step %d.\n", args.ID, run.State.NextStep)
+	execute(cfg, configPath, prompt, run, args.OutputArgs)
+}
+
+// replay plays back the recordings of a run persisted in runs.DefaultDir.
+func replay(argv []string) {
+	var args ReplayArgs
+	p, err := arg.NewParser(arg.Config{Program: "clancy replay"}, &args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	p.MustParse(argv)
+
+	run, err := runs.Open(runs.DefaultDir, args.ID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	paths := run.Recordings(args.Step)
+	if len(paths) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: run %s has no recordings, enable agent.record to create them\n", args.ID)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for _, path := range paths {
+		fmt.Fprintf(os.Stderr, "\n>>> [Clancy] Replaying %s\n\n", filepath.Base(path))
+		if err := playFile(ctx, path, float64(args.Speed)); err != nil {
+			if ctx.Err() != nil {
+				os.Exit(exitInterrupted)
+			}
+			fmt.Fprintf(os.Stderr, "Error replaying %s: %v\n", path, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// playFile plays the asciicast recording at path on stdout.
+func playFile(ctx context.Context, path string, speed float64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	_, events, err := asciicast.Read(f)
+	if err != nil {
+		return err
+	}
+	return asciicast.Play(ctx, os.Stdout, events, speed, replayMaxIdle)
+}
+
+// execute runs the loop for run and exits with the matching exit code.
+func execute(cfg *config.Config, configPath, prompt string, run *runs.Run, out OutputArgs) {
+	// Output meant for humans: the boxes and the agent output.
+	var display io.Writer = os.Stdout
+	var observers []loop.Observer
+	if out.Events == "json" {
+		// Keep stdout clean for the events.
+		display = os.Stderr
+		observers = append(observers, events.NewWriter(os.Stdout))
+	}
+	if out.TUI {
+		// The dashboard shows the output from the observer notifications.
+		display = io.Discard
+	} else {
+		observers = append(observers, loop.NewConsole(display, os.Stderr))
+	}
+	if out.EventsFile != "" {
+		f, err := os.OpenFile(out.EventsFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening events file: %v\n", err)
+			os.Exit(1)
+		}
+		defer func() { _ = f.Close() }()
+		observers = append(observers, events.NewWriter(f))
+	}
+	var tracer *telemetry.Tracer
+	if cfg.Telemetry.Enabled {
+		otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+			fmt.Fprintf(os.Stderr, ">>> [Clancy] Warning: telemetry: %v\n", err)
+		}))
+		var err error
+		tracer, err = telemetry.New(context.Background(), cfg, configPath, run.Dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error setting up telemetry: %v\n", err)
+			os.Exit(1)
+		}
+		observers = append(observers, tracer)
+	}
+
 	// 3. Initialize Runner
 	r := runner.NewRealRunner()
+	r.Stdout = display
+	r.GracePeriod = cfg.Agent.GracePeriodDuration
+	r.IdleTimeout = cfg.Loop.IdleTimeoutDuration
+	if cfg.Loop.StreamStop {
+		r.StopCheck, r.StopQuiet = loop.StreamStop(cfg)
+	}
 
 	// 4. Run Loop
-	fmt.Fprintf(os.Stderr, ">>> [Clancy] Starting loop. Config: %s, Steps: %d, Timeout: %s\n",
-		args.Config, cfg.Loop.MaxSteps, cfg.Loop.Timeout)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	if err := loop.Run(cfg, r, prompt); err != nil {
-		fmt.Fprintf(os.Stderr, ">>> [Clancy] Failed: %v\n", err)
-		os.Exit(1)
+	ctrl := loop.NewControl()
+	go handleSignals(r, ctrl, cancel)
+	go handlePauseSignals(ctrl)
+
+	if out.Listen != "" {
+		m := metrics.New(configPath, cfg.Agent.Command, ctrl)
+		srv := server.New(server.Options{
+			Control: ctrl,
+			Abort: func() {
+				ctrl.Stop()
+				_ = r.Signal(os.Interrupt)
+			},
+			Run:     run,
+			Token:   out.Token,
+			Metrics: m.Handler(),
+		})
+		shutdown, err := serve(out.Listen, srv.Handler())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting the HTTP API: %v\n", err)
+			os.Exit(1)
+		}
+		defer shutdown()
+		observers = append(observers, srv, m)
+
+		fmt.Fprintf(os.Stderr, ">>> [Clancy] HTTP API listening on http://%s\n", out.Listen)
+		if out.Token == "" && !isLoopback(out.Listen) {
+			fmt.Fprintf(os.Stderr, ">>> [Clancy] Warning: the HTTP API has no token, anyone who can reach %s can control the run.\n", out.Listen)
+		}
+	}
+
+	var err error
+	if out.TUI {
+		err = runDashboard(ctx, cfg, configPath, r, prompt, run, ctrl, cancel, observers)
+	} else {
+		fmt.Fprintf(os.Stderr, ">>> [Clancy] Starting loop. Config: %s, Steps: %d, Timeout: %s, Run: %s\n",
+			configPath, cfg.Loop.MaxSteps, cfg.Loop.Timeout, run.State.ID)
+		err = loop.Run(ctx, cfg, r, prompt, loop.WithControl(ctrl), loop.WithRun(run), loop.WithConfigFile(configPath), loop.WithVerifier(r.Plain()), loop.WithObservers(observers...))
+	}
+	if tracer != nil {
+		// Flush the spans before exiting, even on failure.
+		flushCtx, cancelFlush := context.WithTimeout(context.Background(), telemetryFlushTimeout)
+		if err := tracer.Shutdown(flushCtx); err != nil {
+			fmt.Fprintf(os.Stderr, ">>> [Clancy] Warning: failed to export the trace: %v\n", err)
+		}
+		cancelFlush()
+	}
+	if err != nil {
+		if errors.Is(err, loop.ErrInterrupted) {
+			fmt.Fprintf(os.Stderr, ">>> [Clancy] Interrupted. Resume with: clancy resume %s\n", run.State.ID)
+		} else {
+			fmt.Fprintf(os.Stderr, ">>> [Clancy] Failed: %v\n", err)
+		}
+		os.Exit(exitCode(err))
 	}
 
 	fmt.Fprintf(os.Stderr, ">>> [Clancy] Success.\n")
 }
 
+// runDashboard runs the loop in the background while the dashboard shows its
+// progress. The dashboard stays open after the run ends until the user quits.
+func runDashboard(ctx context.Context, cfg *config.Config, configPath string, r *runner.RealRunner, prompt string, run *runs.Run, ctrl *loop.Control, cancel context.CancelFunc, observers []loop.Observer) error {
+	ui := tui.New(tui.Options{
+		Control: ctrl,
+		Stop: func() {
+			ctrl.Stop()
+			_ = r.Signal(os.Interrupt)
+		},
+		Kill: func() {
+			ctrl.Stop()
+			_ = r.Kill()
+			cancel()
+		},
+		Run: run,
+	})
+	observers = append(observers, ui.Observer())
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- loop.Run(ctx, cfg, r, prompt, loop.WithControl(ctrl), loop.WithRun(run), loop.WithConfigFile(configPath), loop.WithVerifier(r.Plain()), loop.WithObservers(observers...))
+	}()
+
+	if err := ui.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, ">>> [Clancy] Dashboard failed: %v\n", err)
+	}
+	// Quitting early, e.g. after a dashboard failure, ends the loop too.
+	ctrl.Stop()
+	_ = r.Signal(os.Interrupt)
+	return <-errc
+}
+
+// serve starts an HTTP server for h on addr. The returned function shuts it
+// down.
+func serve(addr string, h http.Handler) (func(), error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	go func() { _ = srv.Serve(ln) }()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}, nil
+}
+
+// isLoopback reports whether addr only accepts local connections.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// handleSignals implements a two stage shutdown. The first SIGINT/SIGTERM is
+// forwarded to the agent and the loop stops once the current step ends. A
+// second one kills the agent right away.
+func handleSignals(r *runner.RealRunner, ctrl *loop.Control, cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-sigs
+	fmt.Fprintf(os.Stderr, "\n>>> [Clancy] Received %v, finishing the current step. Press Ctrl-C again to force quit.\n", sig)
+	ctrl.Stop()
+	_ = r.Signal(sig)
+
+	<-sigs
+	fmt.Fprintf(os.Stderr, "\n>>> [Clancy] Force quitting, killing the agent.\n")
+	_ = r.Kill()
+	cancel()
+}
+
+// exitCode maps an error returned by loop.Run to the process exit code.
+func exitCode(err error) int {
+	var abortErr *loop.AbortError
+	switch {
+	case errors.As(err, &abortErr):
+		return exitAborted
+	case errors.Is(err, loop.ErrInterrupted):
+		return exitInterrupted
+	default:
+		return exitFailure
+	}
+}
+
+// checkOutputArgs rejects invalid combinations of output flags.
+func checkOutputArgs(p *arg.Parser, out OutputArgs) {
+	if out.Events != "" && out.Events != "json" {
+		p.Fail("--events only supports json")
+	}
+	if out.Events != "" && out.TUI {
+		p.Fail("--events cannot be used with --tui, both write to stdout; use --events-file instead")
+	}
+}
+
+// resolvePrompt resolves the prompt of cfg and, with input.template, checks
+// that it parses, before a run is created for it.
+func resolvePrompt(cfg *config.Config) (string, error) {
+	prompt, err := cfg.ResolvePrompt()
+	if err != nil {
+		return "", err
+	}
+	if cfg.Input.Template {
+		if _, err := loop.ParsePrompt(prompt); err != nil {
+			return "", fmt.Errorf("invalid prompt template: %w", err)
+		}
+	}
+	return prompt, nil
+}
+
 func generateConfig() error {
 	filename := "clancy.yaml"
 
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/eduardolat/clancy/internal/config"
+	"github.com/eduardolat/clancy/internal/runs"
+	"gopkg.in/yaml.v3"
+)
+
+// fingerprint identifies the config and prompt a run uses, to notice when
+// they change between resumes.
+type fingerprint struct {
+	config   string // Hash of the config file
+	prompt   string // Hash of the resolved prompt
+	settings string // Hash of the config without what input.reload reads again
+}
+
+// newFingerprint hashes the config file at path, loaded as cfg, and prompt.
+func newFingerprint(path string, cfg *config.Config, prompt string) (fingerprint, error) {
+	configHash, err := hashFile(path)
+	if err != nil {
+		return fingerprint{}, fmt.Errorf("failed to read config file '%s': %w", path, err)
+	}
+	settingsHash, err := hashSettings(cfg)
+	if err != nil {
+		return fingerprint{}, err
+	}
+	return fingerprint{config: configHash, prompt: runs.Hash([]byte(prompt)), settings: settingsHash}, nil
+}
+
+// save records f in state.
+func (f fingerprint) save(state *runs.State) {
+	state.ConfigHash, state.PromptHash, state.SettingsHash = f.config, f.prompt, f.settings
+}
+
+// checkResume reports why the run in state cannot be resumed with f, nil
+// when it can. Resuming with a different config or prompt would mix two
+// experiments in one run, so it needs force. With reload changes to what
+// input.reload reads again are expected, but not to the rest of the config.
+// Runs saved without the settings hash are compared as a whole.
+func checkResume(state runs.State, f fingerprint, reload, force bool) error {
+	if force {
+		return nil
+	}
+	if reload && state.SettingsHash != "" {
+		if f.settings != state.SettingsHash {
+			return fmt.Errorf("the config changed since run %s started, beyond the prompt, agent.command and agent.env that input.reload reads again", state.ID)
+		}
+		return nil
+	}
+	if f.config != state.ConfigHash || f.prompt != state.PromptHash {
+		return fmt.Errorf("the config or prompt changed since run %s started", state.ID)
+	}
+	return nil
+}
+
+// hashFile returns the runs.Hash of the file at path.
+func hashFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return runs.Hash(data), nil
+}
+
+// hashSettings returns the runs.Hash of cfg without the settings input.reload
+// reads again: the prompt, agent.command and agent.env.
+func hashSettings(cfg *config.Config) (string, error) {
+	settings := *cfg
+	settings.Agent.Command, settings.Agent.Env = "", nil
+	settings.Input.Prompt = ""
+	data, err := yaml.Marshal(settings)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash the config: %w", err)
+	}
+	return runs.Hash(data), nil
+}
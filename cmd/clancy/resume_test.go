@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/eduardolat/clancy/internal/config"
+	"github.com/eduardolat/clancy/internal/runs"
+	"github.com/stretchr/testify/require"
+)
+
+const resumeConfig = `agent:
+  command: "echo hi"
+loop:
+  max_steps: 3
+  stop_phrase: "DONE"
+  timeout: "1m"
+input:
+  prompt: "do work"
+  reload: %s
+`
+
+// fingerprintOf writes a config file and returns its fingerprint, along
+// with whether it enables input.reload.
+func fingerprintOf(t *testing.T, content string) (fingerprint, bool) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "clancy.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+	prompt, err := cfg.ResolvePrompt()
+	require.NoError(t, err)
+	fp, err := newFingerprint(path, cfg, prompt)
+	require.NoError(t, err)
+	return fp, cfg.Input.Reload
+}
+
+func TestCheckResume(t *testing.T) {
+	replace := func(s, old, new string) string {
+		require.Contains(t, s, old)
+		return strings.Replace(s, old, new, 1)
+	}
+	without := fmt.Sprintf(resumeConfig, "false")
+	with := fmt.Sprintf(resumeConfig, "true")
+
+	started := func(content string) runs.State {
+		fp, _ := fingerprintOf(t, content)
+		state := runs.State{ID: "run"}
+		fp.save(&state)
+		return state
+	}
+
+	tests := []struct {
+		name    string
+		before  string
+		after   string
+		force   bool
+		wantErr string
+	}{
+		{name: "unchanged", before: without, after: without},
+		{name: "config changed", before: without, after: replace(without, "max_steps: 3", "max_steps: 4"), wantErr: "the config or prompt changed"},
+		{name: "prompt changed", before: without, after: replace(without, "do work", "do more"), wantErr: "the config or prompt changed"},
+		{name: "forced", before: without, after: replace(without, "max_steps: 3", "max_steps: 4"), force: true},
+		{name: "reload, reloaded settings changed", before: with, after: replace(replace(with, "do work", "do more"), "echo hi", "echo ho")},
+		{name: "reload, other settings changed", before: with, after: replace(with, "max_steps: 3", "max_steps: 4"), wantErr: "beyond the prompt"},
+		{name: "reload, forced", before: with, after: replace(with, "max_steps: 3", "max_steps: 4"), force: true},
+		{name: "reload turned on", before: without, after: replace(with, "echo hi", "echo ho"), wantErr: "beyond the prompt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := started(tt.before)
+			fp, reload := fingerprintOf(t, tt.after)
+			err := checkResume(state, fp, reload, tt.force)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+
+	t.Run("run without settings hash", func(t *testing.T) {
+		// Runs saved before the settings hash existed are compared as a whole.
+		state := started(with)
+		state.SettingsHash = ""
+		fp, reload := fingerprintOf(t, replace(with, "echo hi", "echo ho"))
+		require.ErrorContains(t, checkResume(state, fp, reload, false), "the config or prompt changed")
+	})
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/eduardolat/clancy/internal/loop"
+)
+
+// handlePauseSignals toggles a "pause after the current step" state on
+// SIGUSR1 and resumes the loop on SIGUSR2.
+func handlePauseSignals(ctrl *loop.Control) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGUSR1:
+			if ctrl.Paused() {
+				fmt.Fprintf(os.Stderr, "\n>>> [Clancy] Pause cancelled.\n")
+				ctrl.Resume()
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "\n>>> [Clancy] Pause requested, the loop will pause after the current step.\n")
+			ctrl.Pause()
+		case syscall.SIGUSR2:
+			fmt.Fprintf(os.Stderr, "\n>>> [Clancy] Resume requested.\n")
+			ctrl.Resume()
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Package ansi removes terminal control sequences from captured output.
+package ansi
+
+import (
+	"regexp"
+	"strings"
+)
+
+// sequence matches CSI sequences (colors, cursor movement), OSC sequences
+// (window titles, hyperlinks) and other two-byte escapes.
+var sequence = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|[@-Z\\-_])`)
+
+// Strip removes ANSI escape sequences from s and normalizes CRLF line
+// endings, as produced by a pseudo-terminal, to LF.
+func Strip(s string) string {
+	s = sequence.ReplaceAllString(s, "")
+	return strings.ReplaceAll(s, "\r\n", "\n")
+}
+
+// Tail returns the last n lines of s, without trailing blank lines.
+func Tail(s string, n int) string {
+	s = strings.TrimRight(s, "\r\n\t ")
+	if n <= 0 {
+		return ""
+	}
+	lines := strings.Split(s, "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,21 @@
+package ansi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStrip(t *testing.T) {
+	require.Equal(t, "red text", Strip("\x1b[31mred\x1b[0m text"))
+	require.Equal(t, "bold", Strip("\x1b[1;4mbold\x1b[m"))
+	require.Equal(t, "line 1\nline 2\n", Strip("line 1\r\nline 2\r\n"))
+	require.Equal(t, "after title", Strip("\x1b]0;🍩 Clancy\x07after title"))
+	require.Equal(t, "plain", Strip("plain"))
+}
+
+func TestTail(t *testing.T) {
+	require.Equal(t, "c\nd", Tail("a\nb\nc\nd\n\n", 2))
+	require.Equal(t, "a\nb", Tail("a\nb", 10))
+	require.Equal(t, "", Tail("a\nb", 0))
+}
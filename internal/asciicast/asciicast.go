@@ -0,0 +1,178 @@
+// Package asciicast records and plays back terminal sessions in the
+// asciicast v2 format used by asciinema.
+// See https://docs.asciinema.org/manual/asciicast/v2/.
+package asciicast
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Header is the first line of a recording.
+type Header struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Title     string `json:"title,omitempty"`
+}
+
+// Event is a chunk of output and the time it was written, relative to the
+// start of the recording.
+type Event struct {
+	Time time.Duration
+	Data string
+}
+
+// Writer records everything written to it as output events. It is safe for
+// concurrent use.
+type Writer struct {
+	mu      sync.Mutex
+	w       io.Writer
+	start   time.Time
+	pending []byte // Incomplete UTF-8 sequence from the previous write
+	err     error
+}
+
+// NewWriter writes the header to w and returns a Writer that appends
+// output events to it.
+func NewWriter(w io.Writer, width, height int, title string) (*Writer, error) {
+	start := time.Now()
+	header, err := json.Marshal(Header{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: start.Unix(),
+		Title:     title,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", header); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, start: start}, nil
+}
+
+// Write records p as an output event. A multi-byte character split across
+// writes is held back until it is complete, as events must be valid UTF-8.
+func (c *Writer) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	data := append(c.pending, p...)
+	cut := completeUTF8(data)
+	c.pending = append([]byte(nil), data[cut:]...)
+	if cut == 0 {
+		return len(p), nil
+	}
+
+	elapsed := time.Since(c.start).Seconds()
+	event, err := json.Marshal([]any{elapsed, "o", string(data[:cut])})
+	if err != nil {
+		c.err = err
+		return 0, err
+	}
+	if _, err := fmt.Fprintf(c.w, "%s\n", event); err != nil {
+		c.err = err
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// completeUTF8 returns the length of the longest prefix of p that does not
+// end in the middle of a multi-byte character.
+func completeUTF8(p []byte) int {
+	// A character is at most utf8.UTFMax bytes, so only the tail can be cut.
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(p[i]) {
+			continue
+		}
+		if utf8.FullRune(p[i:]) {
+			return len(p)
+		}
+		return i
+	}
+	return len(p)
+}
+
+// Read parses a recording. Events other than output are skipped.
+func Read(r io.Reader) (Header, []Event, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	var header Header
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return header, nil, err
+		}
+		return header, nil, errors.New("empty recording")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return header, nil, fmt.Errorf("invalid header: %w", err)
+	}
+	if header.Version != 2 {
+		return header, nil, fmt.Errorf("unsupported asciicast version %d", header.Version)
+	}
+
+	var events []Event
+	for line := 2; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var raw [3]any
+		if err := json.Unmarshal(scanner.Bytes(), &raw); err != nil {
+			return header, nil, fmt.Errorf("invalid event on line %d: %w", line, err)
+		}
+		secs, ok1 := raw[0].(float64)
+		kind, ok2 := raw[1].(string)
+		data, ok3 := raw[2].(string)
+		if !ok1 || !ok2 || !ok3 {
+			return header, nil, fmt.Errorf("invalid event on line %d", line)
+		}
+		if kind != "o" {
+			continue
+		}
+		events = append(events, Event{Time: time.Duration(secs * float64(time.Second)), Data: data})
+	}
+	return header, events, scanner.Err()
+}
+
+// Play writes events to w with their original timing divided by speed.
+// Pauses longer than maxIdle are shortened to maxIdle; zero keeps them.
+func Play(ctx context.Context, w io.Writer, events []Event, speed float64, maxIdle time.Duration) error {
+	if speed <= 0 {
+		speed = 1
+	}
+
+	var last time.Duration
+	for _, e := range events {
+		wait := e.Time - last
+		last = e.Time
+		if maxIdle > 0 && wait > maxIdle {
+			wait = maxIdle
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(float64(wait) / speed)):
+		}
+
+		if _, err := io.WriteString(w, e.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package asciicast
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterAndRead(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, 120, 40, "step 01")
+	require.NoError(t, err)
+
+	_, err = w.Write([]byte("hello \x1b[32mworld\x1b[0m\r\n"))
+	require.NoError(t, err)
+
+	// "é" split across two writes must not produce invalid UTF-8.
+	_, err = w.Write([]byte{'c', 'a', 'f', 0xc3})
+	require.NoError(t, err)
+	_, err = w.Write([]byte{0xa9, '\n'})
+	require.NoError(t, err)
+
+	header, events, err := Read(&buf)
+	require.NoError(t, err)
+	require.Equal(t, 2, header.Version)
+	require.Equal(t, 120, header.Width)
+	require.Equal(t, 40, header.Height)
+	require.Equal(t, "step 01", header.Title)
+
+	require.Len(t, events, 3)
+	require.Equal(t, "hello \x1b[32mworld\x1b[0m\r\n", events[0].Data)
+	require.Equal(t, "caf", events[1].Data)
+	require.Equal(t, "é\n", events[2].Data)
+}
+
+func TestRead_Invalid(t *testing.T) {
+	_, _, err := Read(strings.NewReader(""))
+	require.ErrorContains(t, err, "empty recording")
+
+	_, _, err = Read(strings.NewReader(`{"version": 1}`))
+	require.ErrorContains(t, err, "unsupported asciicast version 1")
+
+	_, _, err = Read(strings.NewReader("{\"version\": 2}\n[0.5, \"o\"]\n"))
+	require.ErrorContains(t, err, "invalid event on line 2")
+}
+
+func TestPlay(t *testing.T) {
+	events := []Event{
+		{Time: 0, Data: "a"},
+		{Time: 200 * time.Millisecond, Data: "b"},
+		{Time: time.Hour, Data: "c"},
+	}
+
+	var buf bytes.Buffer
+	start := time.Now()
+	require.NoError(t, Play(context.Background(), &buf, events, 4, 100*time.Millisecond))
+	require.Equal(t, "abc", buf.String())
+	// 200ms at 4x plus the hour capped to 100ms at 4x.
+	require.Less(t, time.Since(start), time.Second)
+}
@@ -2,7 +2,10 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,31 +14,158 @@ import (
 
 // Config represents the top-level configuration structure for Clancy.
 type Config struct {
-	Agent AgentConfig `yaml:"agent"`
-	Loop  LoopConfig  `yaml:"loop"`
-	Input InputConfig `yaml:"input"`
+	Agent     AgentConfig     `yaml:"agent"`
+	Loop      LoopConfig      `yaml:"loop"`
+	Input     InputConfig     `yaml:"input"`
+	Telemetry TelemetryConfig `yaml:"telemetry"`
 }
 
 // AgentConfig defines settings for the AI agent command.
 type AgentConfig struct {
-	Command string            `yaml:"command"`
-	Env     map[string]string `yaml:"env"`
+	Command             string            `yaml:"command"`
+	Env                 map[string]string `yaml:"env"`
+	GracePeriod         string            `yaml:"grace_period"`
+	GracePeriodDuration time.Duration     `yaml:"-"`      // Parsed duration
+	Record              bool              `yaml:"record"` // Save every step as an asciicast recording
 }
 
+// Step timeout policies. They decide what happens to the loop when a single
+// agent invocation exceeds loop.step_timeout.
+const (
+	StepTimeoutContinue = "continue" // Count the step and move to the next one
+	StepTimeoutAbort    = "abort"    // Stop the whole loop with an error
+)
+
+// Phrase match semantics used when several stop phrases are configured.
+const (
+	MatchAny = "any" // One matching phrase is enough
+	MatchAll = "all" // Every phrase must match
+)
+
 // LoopConfig defines constraints and stopping criteria for the execution loop.
 type LoopConfig struct {
-	MaxSteps        int           `yaml:"max_steps"`
-	Timeout         string        `yaml:"timeout"`
-	StopPhrase      string        `yaml:"stop_phrase"`
-	StopMode        string        `yaml:"stop_mode"`
-	Delay           string        `yaml:"delay"`
-	DelayDuration   time.Duration `yaml:"-"` // Parsed duration
-	TimeoutDuration time.Duration `yaml:"-"` // Parsed duration
+	MaxSteps                int              `yaml:"max_steps"`
+	Timeout                 string           `yaml:"timeout"`
+	PauseFreezesTimeout     bool             `yaml:"pause_freezes_timeout"`
+	StepTimeout             string           `yaml:"step_timeout"`
+	OnStepTimeout           string           `yaml:"on_step_timeout"`
+	IdleTimeout             string           `yaml:"idle_timeout"`
+	StopPhrase              string           `yaml:"stop_phrase"`
+	StopPhrases             []string         `yaml:"stop_phrases"`
+	StopMode                string           `yaml:"stop_mode"`
+	StopMatch               string           `yaml:"stop_match"`
+	AbortPhrases            []string         `yaml:"abort_phrases"`
+	AbortMode               string           `yaml:"abort_mode"`
+	Verify                  string           `yaml:"verify"`
+	OnExitCode              []ExitCodeRule   `yaml:"on_exit_code"`
+	MaxConsecutiveFailures  int              `yaml:"max_consecutive_failures"`
+	Backoff                 []BackoffRule    `yaml:"backoff"`
+	StreamStop              bool             `yaml:"stream_stop"`
+	StreamStopQuiet         string           `yaml:"stream_stop_quiet"`
+	Delay                   string           `yaml:"delay"`
+	DelayDuration           time.Duration    `yaml:"-"` // Parsed duration
+	TimeoutDuration         time.Duration    `yaml:"-"` // Parsed duration
+	StepTimeoutDuration     time.Duration    `yaml:"-"` // Parsed duration
+	IdleTimeoutDuration     time.Duration    `yaml:"-"` // Parsed duration
+	StreamStopQuietDuration time.Duration    `yaml:"-"` // Parsed duration
+	StopRegexps             []*regexp.Regexp `yaml:"-"` // Compiled StopPhraseList in "regex" mode
+	AbortRegexps            []*regexp.Regexp `yaml:"-"` // Compiled AbortPhrases in "regex" mode
+}
+
+// Actions for exit code rules.
+const (
+	ExitActionContinue = "continue"        // Treat the step as a normal iteration
+	ExitActionSucceed  = "succeed"         // End the loop successfully, once loop.verify passes
+	ExitActionFail     = "fail"            // End the loop with an error
+	ExitActionRetry    = "retry_same_step" // Run the step again without counting it, a few times in a row
+)
+
+// ExitCodeRule maps an agent exit code, or an inclusive range of them, to an
+// action. Codes is either a single code ("2") or a range ("10-20").
+type ExitCodeRule struct {
+	Codes  string `yaml:"codes"`
+	Action string `yaml:"action"`
+	Min    int    `yaml:"-"` // Parsed lower bound
+	Max    int    `yaml:"-"` // Parsed upper bound
+}
+
+// Matches reports whether code falls within the rule's range.
+func (r ExitCodeRule) Matches(code int) bool {
+	return code >= r.Min && code <= r.Max
+}
+
+// Backoff strategies.
+const (
+	BackoffExponential = "exponential" // Double the delay on every consecutive match
+	BackoffFixed       = "fixed"       // Always wait the same delay
+)
+
+// BackoffRule makes the loop wait, without using up a step, when the agent
+// output matches Pattern (e.g. "rate limit exceeded"). If Until is set and
+// its first capture group holds a time (e.g. "resets at (3pm)"), the loop
+// sleeps until then instead. Max caps every wait.
+type BackoffRule struct {
+	Pattern       string         `yaml:"pattern"`
+	Strategy      string         `yaml:"strategy"`
+	Delay         string         `yaml:"delay"`
+	Max           string         `yaml:"max"`
+	Until         string         `yaml:"until"`
+	Regexp        *regexp.Regexp `yaml:"-"` // Compiled Pattern
+	UntilRegexp   *regexp.Regexp `yaml:"-"` // Compiled Until
+	DelayDuration time.Duration  `yaml:"-"` // Parsed duration
+	MaxDuration   time.Duration  `yaml:"-"` // Parsed duration
+}
+
+// StopPhraseList returns every configured stop phrase: stop_phrase first,
+// followed by stop_phrases.
+func (l *LoopConfig) StopPhraseList() []string {
+	phrases := make([]string, 0, len(l.StopPhrases)+1)
+	if l.StopPhrase != "" || len(l.StopPhrases) == 0 {
+		phrases = append(phrases, l.StopPhrase)
+	}
+	return append(phrases, l.StopPhrases...)
 }
 
 // InputConfig defines the input prompt source.
 type InputConfig struct {
-	Prompt string `yaml:"prompt"`
+	Prompt    string            `yaml:"prompt"`
+	Template  bool              `yaml:"template"` // Render the prompt as a Go text/template on every step
+	Vars      map[string]string `yaml:"vars"`     // Available to the template as .Vars
+	Reload    bool              `yaml:"reload"`   // Read the prompt, agent.command and agent.env again before every step
+	CarryOver CarryOverConfig   `yaml:"carry_over"`
+	Progress  ProgressConfig    `yaml:"progress"`
+}
+
+// ProgressConfig gives the agent a scratchpad file to keep notes between
+// steps. Clancy creates it, replaces ${PROGRESS_FILE} with its path in the
+// prompt and the agent command, and snapshots it after every step.
+type ProgressConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	File       string `yaml:"file"`        // Defaults to progress.md in the run directory
+	StallSteps int    `yaml:"stall_steps"` // End the run when the file did not change for this many steps
+}
+
+// CarryOverConfig appends the end of the previous step's output to the next
+// prompt, so the agent knows where it left off. With StartMarker, only the
+// text after its last occurrence is kept, up to EndMarker if set. Lines and
+// MaxBytes bound what is carried over either way.
+type CarryOverConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Lines       int    `yaml:"lines"`
+	MaxBytes    int    `yaml:"max_bytes"`
+	StartMarker string `yaml:"start_marker"`
+	EndMarker   string `yaml:"end_marker"`
+}
+
+// TelemetryConfig enables OpenTelemetry tracing of runs. Spans are sent to
+// an OTLP/HTTP collector at Endpoint, or written as JSON to File when no
+// endpoint is set.
+type TelemetryConfig struct {
+	Enabled     bool              `yaml:"enabled"`
+	Endpoint    string            `yaml:"endpoint"` // e.g. "http://localhost:4318"
+	Headers     map[string]string `yaml:"headers"`  // Sent to the collector, e.g. for authentication
+	File        string            `yaml:"file"`     // Defaults to trace.json in the run directory
+	ServiceName string            `yaml:"service_name"`
 }
 
 // Load reads the configuration from a YAML file.
@@ -60,6 +190,66 @@ func Load(path string) (*Config, error) {
 	if cfg.Loop.Timeout == "" {
 		cfg.Loop.Timeout = "30m"
 	}
+	if cfg.Loop.StopMatch == "" {
+		cfg.Loop.StopMatch = MatchAny
+	}
+	if cfg.Loop.AbortMode == "" {
+		cfg.Loop.AbortMode = "contains"
+	}
+	if cfg.Loop.OnStepTimeout == "" {
+		cfg.Loop.OnStepTimeout = StepTimeoutContinue
+	}
+	if cfg.Loop.StreamStopQuiet == "" {
+		cfg.Loop.StreamStopQuiet = "5s"
+	}
+	if cfg.Agent.GracePeriod == "" {
+		cfg.Agent.GracePeriod = "5s"
+	}
+	if cfg.Input.CarryOver.Lines == 0 {
+		cfg.Input.CarryOver.Lines = 50
+	}
+	if cfg.Input.CarryOver.MaxBytes == 0 {
+		cfg.Input.CarryOver.MaxBytes = 8 * 1024
+	}
+	if cfg.Telemetry.ServiceName == "" {
+		cfg.Telemetry.ServiceName = "clancy"
+	}
+
+	// Validate stop and abort phrases
+	switch cfg.Loop.StopMatch {
+	case MatchAny, MatchAll:
+	default:
+		return nil, fmt.Errorf("invalid stop_match %q: must be %q or %q",
+			cfg.Loop.StopMatch, MatchAny, MatchAll)
+	}
+	if cfg.Loop.StopMode == "regex" {
+		regexps, err := compilePhrases(cfg.Loop.StopPhraseList())
+		if err != nil {
+			return nil, fmt.Errorf("invalid stop phrase: %w", err)
+		}
+		cfg.Loop.StopRegexps = regexps
+	}
+	if cfg.Loop.AbortMode == "regex" {
+		regexps, err := compilePhrases(cfg.Loop.AbortPhrases)
+		if err != nil {
+			return nil, fmt.Errorf("invalid abort phrase: %w", err)
+		}
+		cfg.Loop.AbortRegexps = regexps
+	}
+
+	// Parse exit code rules
+	for i := range cfg.Loop.OnExitCode {
+		if err := parseExitCodeRule(&cfg.Loop.OnExitCode[i]); err != nil {
+			return nil, fmt.Errorf("invalid on_exit_code rule %d: %w", i+1, err)
+		}
+	}
+
+	// Parse backoff rules
+	for i := range cfg.Loop.Backoff {
+		if err := parseBackoffRule(&cfg.Loop.Backoff[i]); err != nil {
+			return nil, fmt.Errorf("invalid backoff rule %d: %w", i+1, err)
+		}
+	}
 
 	// Parse timeout
 	duration, err := time.ParseDuration(cfg.Loop.Timeout)
@@ -68,6 +258,44 @@ func Load(path string) (*Config, error) {
 	}
 	cfg.Loop.TimeoutDuration = duration
 
+	// Parse step timeout
+	if cfg.Loop.StepTimeout != "" {
+		stepTimeout, err := time.ParseDuration(cfg.Loop.StepTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid step_timeout format: %w", err)
+		}
+		cfg.Loop.StepTimeoutDuration = stepTimeout
+	}
+	switch cfg.Loop.OnStepTimeout {
+	case StepTimeoutContinue, StepTimeoutAbort:
+	default:
+		return nil, fmt.Errorf("invalid on_step_timeout %q: must be %q or %q",
+			cfg.Loop.OnStepTimeout, StepTimeoutContinue, StepTimeoutAbort)
+	}
+
+	// Parse idle timeout
+	if cfg.Loop.IdleTimeout != "" {
+		idleTimeout, err := time.ParseDuration(cfg.Loop.IdleTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid idle_timeout format: %w", err)
+		}
+		cfg.Loop.IdleTimeoutDuration = idleTimeout
+	}
+
+	// Parse stream stop quiet period
+	streamStopQuiet, err := time.ParseDuration(cfg.Loop.StreamStopQuiet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stream_stop_quiet format: %w", err)
+	}
+	cfg.Loop.StreamStopQuietDuration = streamStopQuiet
+
+	// Parse grace period
+	gracePeriod, err := time.ParseDuration(cfg.Agent.GracePeriod)
+	if err != nil {
+		return nil, fmt.Errorf("invalid grace_period format: %w", err)
+	}
+	cfg.Agent.GracePeriodDuration = gracePeriod
+
 	// Parse delay
 	if cfg.Loop.Delay != "" {
 		delay, err := time.ParseDuration(cfg.Loop.Delay)
@@ -77,9 +305,121 @@ func Load(path string) (*Config, error) {
 		cfg.Loop.DelayDuration = delay
 	}
 
+	// Validate carry over
+	carry := cfg.Input.CarryOver
+	if carry.Lines < 0 || carry.MaxBytes < 0 {
+		return nil, fmt.Errorf("invalid carry_over: lines and max_bytes must be positive")
+	}
+	if carry.EndMarker != "" && carry.StartMarker == "" {
+		return nil, fmt.Errorf("invalid carry_over: end_marker requires start_marker")
+	}
+
+	if cfg.Input.Progress.StallSteps < 0 {
+		return nil, fmt.Errorf("invalid progress.stall_steps: must be positive")
+	}
+
+	// Validate the collector endpoint
+	if cfg.Telemetry.Endpoint != "" {
+		u, err := url.Parse(cfg.Telemetry.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid telemetry endpoint %q: must be an http or https URL", cfg.Telemetry.Endpoint)
+		}
+	}
+
 	return &cfg, nil
 }
 
+// parseExitCodeRule validates the action and fills Min and Max from Codes.
+func parseExitCodeRule(rule *ExitCodeRule) error {
+	switch rule.Action {
+	case ExitActionContinue, ExitActionSucceed, ExitActionFail, ExitActionRetry:
+	default:
+		return fmt.Errorf("unknown action %q", rule.Action)
+	}
+
+	first, last, isRange := strings.Cut(rule.Codes, "-")
+	lo, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return fmt.Errorf("bad exit code %q", rule.Codes)
+	}
+	hi := lo
+	if isRange {
+		hi, err = strconv.Atoi(strings.TrimSpace(last))
+		if err != nil || hi < lo {
+			return fmt.Errorf("bad exit code range %q", rule.Codes)
+		}
+	}
+
+	rule.Min, rule.Max = lo, hi
+	return nil
+}
+
+// parseBackoffRule applies defaults, compiles the patterns and parses the
+// durations of a backoff rule.
+func parseBackoffRule(rule *BackoffRule) error {
+	if rule.Strategy == "" {
+		rule.Strategy = BackoffExponential
+	}
+	if rule.Delay == "" {
+		rule.Delay = "30s"
+	}
+
+	switch rule.Strategy {
+	case BackoffExponential, BackoffFixed:
+	default:
+		return fmt.Errorf("unknown strategy %q", rule.Strategy)
+	}
+
+	if rule.Pattern == "" {
+		return fmt.Errorf("pattern is required")
+	}
+	re, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		return fmt.Errorf("bad pattern %q: %w", rule.Pattern, err)
+	}
+	rule.Regexp = re
+
+	if rule.Until != "" {
+		re, err := regexp.Compile(rule.Until)
+		if err != nil {
+			return fmt.Errorf("bad until pattern %q: %w", rule.Until, err)
+		}
+		if re.NumSubexp() < 1 {
+			return fmt.Errorf("until pattern %q needs a capture group for the time", rule.Until)
+		}
+		rule.UntilRegexp = re
+	}
+
+	delay, err := time.ParseDuration(rule.Delay)
+	if err != nil {
+		return fmt.Errorf("invalid delay format: %w", err)
+	}
+	rule.DelayDuration = delay
+
+	if rule.Max != "" {
+		maxDelay, err := time.ParseDuration(rule.Max)
+		if err != nil {
+			return fmt.Errorf("invalid max format: %w", err)
+		}
+		rule.MaxDuration = maxDelay
+	}
+
+	return nil
+}
+
+// compilePhrases compiles each phrase as a Go RE2 regular expression.
+func compilePhrases(phrases []string) ([]*regexp.Regexp, error) {
+	regexps := make([]*regexp.Regexp, 0, len(phrases))
+	for _, phrase := range phrases {
+		re, err := regexp.Compile(phrase)
+		if err != nil {
+			return nil, fmt.Errorf("bad regex %q: %w", phrase, err)
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
 // ResolvePrompt handles the "file:" prefix logic.
 // If the prompt starts with "file:", it reads the content from that path.
 // Otherwise, it returns the prompt as is.
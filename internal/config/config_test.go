@@ -15,6 +15,7 @@ agent:
   command: "echo 'hello'"
   env:
     FOO: "bar"
+  grace_period: "2s"
 loop:
   max_steps: 5
   timeout: "1h"
@@ -31,6 +32,7 @@ input:
 
 	require.Equal(t, "echo 'hello'", cfg.Agent.Command)
 	require.Equal(t, "bar", cfg.Agent.Env["FOO"])
+	require.Equal(t, 2*time.Second, cfg.Agent.GracePeriodDuration)
 	require.Equal(t, 5, cfg.Loop.MaxSteps)
 	require.Equal(t, "DONE", cfg.Loop.StopPhrase)
 	require.Equal(t, "exact", cfg.Loop.StopMode)
@@ -53,6 +55,8 @@ input:
 	cfg, err := Load(tmpfile)
 	require.NoError(t, err)
 	require.Equal(t, "suffix", cfg.Loop.StopMode)
+	require.Equal(t, "contains", cfg.Loop.AbortMode)
+	require.Equal(t, 5*time.Second, cfg.Agent.GracePeriodDuration)
 }
 
 func TestDelayParsing(t *testing.T) {
@@ -102,3 +106,256 @@ func TestResolvePrompt_FileMissing(t *testing.T) {
 	_, err := cfg.ResolvePrompt()
 	require.Error(t, err)
 }
+
+func TestStepTimeoutParsing(t *testing.T) {
+	content := `
+agent:
+  command: "echo"
+loop:
+  step_timeout: "10m"
+  on_step_timeout: "abort"
+  idle_timeout: "90s"
+input:
+  prompt: "foo"
+`
+	tmpfile := filepath.Join(t.TempDir(), "clancy_step_timeout.yaml")
+	require.NoError(t, os.WriteFile(tmpfile, []byte(content), 0644))
+
+	cfg, err := Load(tmpfile)
+	require.NoError(t, err)
+	require.Equal(t, 10*time.Minute, cfg.Loop.StepTimeoutDuration)
+	require.Equal(t, StepTimeoutAbort, cfg.Loop.OnStepTimeout)
+	require.Equal(t, 90*time.Second, cfg.Loop.IdleTimeoutDuration)
+}
+
+func TestStepTimeoutPolicyInvalid(t *testing.T) {
+	content := `
+agent:
+  command: "echo"
+loop:
+  on_step_timeout: "explode"
+input:
+  prompt: "foo"
+`
+	tmpfile := filepath.Join(t.TempDir(), "clancy_step_timeout_invalid.yaml")
+	require.NoError(t, os.WriteFile(tmpfile, []byte(content), 0644))
+
+	_, err := Load(tmpfile)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "on_step_timeout")
+}
+
+func TestStopPhrasesRegex(t *testing.T) {
+	content := `
+agent:
+  command: "echo"
+loop:
+  stop_mode: "regex"
+  stop_match: "all"
+  stop_phrases:
+    - "<promise>DONE</promise>$"
+    - "tests: \\d+ passed"
+input:
+  prompt: "foo"
+`
+	tmpfile := filepath.Join(t.TempDir(), "clancy_regex.yaml")
+	require.NoError(t, os.WriteFile(tmpfile, []byte(content), 0644))
+
+	cfg, err := Load(tmpfile)
+	require.NoError(t, err)
+	require.Equal(t, MatchAll, cfg.Loop.StopMatch)
+	require.Equal(t, []string{"<promise>DONE</promise>$", `tests: \d+ passed`}, cfg.Loop.StopPhraseList())
+	require.Len(t, cfg.Loop.StopRegexps, 2)
+	require.True(t, cfg.Loop.StopRegexps[1].MatchString("tests: 12 passed"))
+}
+
+func TestStopPhrasesRegexInvalid(t *testing.T) {
+	content := `
+agent:
+  command: "echo"
+loop:
+  stop_mode: "regex"
+  stop_phrase: "DONE("
+input:
+  prompt: "foo"
+`
+	tmpfile := filepath.Join(t.TempDir(), "clancy_regex_invalid.yaml")
+	require.NoError(t, os.WriteFile(tmpfile, []byte(content), 0644))
+
+	_, err := Load(tmpfile)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `bad regex "DONE("`)
+}
+
+func TestStopPhraseList(t *testing.T) {
+	l := LoopConfig{StopPhrase: "DONE"}
+	require.Equal(t, []string{"DONE"}, l.StopPhraseList())
+
+	l = LoopConfig{StopPhrase: "DONE", StopPhrases: []string{"FINISHED"}}
+	require.Equal(t, []string{"DONE", "FINISHED"}, l.StopPhraseList())
+
+	l = LoopConfig{StopPhrases: []string{"FINISHED"}}
+	require.Equal(t, []string{"FINISHED"}, l.StopPhraseList())
+}
+
+func TestOnExitCodeParsing(t *testing.T) {
+	content := `
+agent:
+  command: "echo"
+loop:
+  on_exit_code:
+    - codes: "2"
+      action: "fail"
+    - codes: "10-20"
+      action: "retry_same_step"
+input:
+  prompt: "foo"
+`
+	tmpfile := filepath.Join(t.TempDir(), "clancy_exit_codes.yaml")
+	require.NoError(t, os.WriteFile(tmpfile, []byte(content), 0644))
+
+	cfg, err := Load(tmpfile)
+	require.NoError(t, err)
+	require.Len(t, cfg.Loop.OnExitCode, 2)
+	require.True(t, cfg.Loop.OnExitCode[0].Matches(2))
+	require.False(t, cfg.Loop.OnExitCode[0].Matches(3))
+	require.Equal(t, ExitActionRetry, cfg.Loop.OnExitCode[1].Action)
+	require.True(t, cfg.Loop.OnExitCode[1].Matches(10))
+	require.True(t, cfg.Loop.OnExitCode[1].Matches(20))
+	require.False(t, cfg.Loop.OnExitCode[1].Matches(21))
+}
+
+func TestOnExitCodeInvalid(t *testing.T) {
+	for name, rule := range map[string]string{
+		"bad action": `{codes: "2", action: "explode"}`,
+		"bad code":   `{codes: "two", action: "fail"}`,
+		"bad range":  `{codes: "20-10", action: "fail"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			content := "loop:\n  on_exit_code:\n    - " + rule + "\n"
+			tmpfile := filepath.Join(t.TempDir(), "clancy_exit_codes_invalid.yaml")
+			require.NoError(t, os.WriteFile(tmpfile, []byte(content), 0644))
+
+			_, err := Load(tmpfile)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "on_exit_code")
+		})
+	}
+}
+
+func TestBackoffParsing(t *testing.T) {
+	content := `
+agent:
+  command: "echo"
+loop:
+  backoff:
+    - pattern: "(?i)rate limit exceeded"
+      max: "10m"
+    - pattern: "usage limit reached"
+      strategy: "fixed"
+      delay: "1m"
+      until: "resets at (\\d+(?::\\d+)?\\s*[ap]m)"
+input:
+  prompt: "foo"
+`
+	tmpfile := filepath.Join(t.TempDir(), "clancy_backoff.yaml")
+	require.NoError(t, os.WriteFile(tmpfile, []byte(content), 0644))
+
+	cfg, err := Load(tmpfile)
+	require.NoError(t, err)
+	require.Len(t, cfg.Loop.Backoff, 2)
+
+	first := cfg.Loop.Backoff[0]
+	require.Equal(t, BackoffExponential, first.Strategy)
+	require.Equal(t, 30*time.Second, first.DelayDuration)
+	require.Equal(t, 10*time.Minute, first.MaxDuration)
+	require.True(t, first.Regexp.MatchString("Rate Limit Exceeded"))
+	require.Nil(t, first.UntilRegexp)
+
+	second := cfg.Loop.Backoff[1]
+	require.Equal(t, BackoffFixed, second.Strategy)
+	require.Equal(t, time.Minute, second.DelayDuration)
+	require.NotNil(t, second.UntilRegexp)
+}
+
+func TestBackoffInvalid(t *testing.T) {
+	for name, rule := range map[string]string{
+		"missing pattern":       `{delay: "1s"}`,
+		"bad pattern":           `{pattern: "rate("}`,
+		"bad strategy":          `{pattern: "rate", strategy: "random"}`,
+		"until without capture": `{pattern: "rate", until: "resets soon"}`,
+		"bad delay":             `{pattern: "rate", delay: "soon"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			content := "loop:\n  backoff:\n    - " + rule + "\n"
+			tmpfile := filepath.Join(t.TempDir(), "clancy_backoff_invalid.yaml")
+			require.NoError(t, os.WriteFile(tmpfile, []byte(content), 0644))
+
+			_, err := Load(tmpfile)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "backoff rule 1")
+		})
+	}
+}
+
+func TestTelemetryParsing(t *testing.T) {
+	content := `
+telemetry:
+  enabled: true
+  endpoint: "http://localhost:4318"
+  headers:
+    Authorization: "Bearer abc"
+`
+	tmpfile := filepath.Join(t.TempDir(), "clancy_telemetry.yaml")
+	require.NoError(t, os.WriteFile(tmpfile, []byte(content), 0644))
+
+	cfg, err := Load(tmpfile)
+	require.NoError(t, err)
+	require.True(t, cfg.Telemetry.Enabled)
+	require.Equal(t, "clancy", cfg.Telemetry.ServiceName)
+	require.Equal(t, "Bearer abc", cfg.Telemetry.Headers["Authorization"])
+}
+
+func TestTelemetryInvalidEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"localhost:4318", "ftp://collector", "http://"} {
+		t.Run(endpoint, func(t *testing.T) {
+			content := "telemetry:\n  endpoint: \"" + endpoint + "\"\n"
+			tmpfile := filepath.Join(t.TempDir(), "clancy_telemetry_invalid.yaml")
+			require.NoError(t, os.WriteFile(tmpfile, []byte(content), 0644))
+
+			_, err := Load(tmpfile)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "telemetry endpoint")
+		})
+	}
+}
+
+func TestCarryOverParsing(t *testing.T) {
+	tmpfile := filepath.Join(t.TempDir(), "clancy_carry_over.yaml")
+	require.NoError(t, os.WriteFile(tmpfile, []byte("input:\n  carry_over:\n    enabled: true\n"), 0644))
+
+	cfg, err := Load(tmpfile)
+	require.NoError(t, err)
+	require.True(t, cfg.Input.CarryOver.Enabled)
+	require.Equal(t, 50, cfg.Input.CarryOver.Lines)
+	require.Equal(t, 8*1024, cfg.Input.CarryOver.MaxBytes)
+
+	require.NoError(t, os.WriteFile(tmpfile, []byte("input:\n  carry_over:\n    end_marker: \"</notes>\"\n"), 0644))
+	_, err = Load(tmpfile)
+	require.ErrorContains(t, err, "end_marker requires start_marker")
+}
+
+func TestProgressParsing(t *testing.T) {
+	tmpfile := filepath.Join(t.TempDir(), "clancy_progress.yaml")
+	require.NoError(t, os.WriteFile(tmpfile, []byte("input:\n  progress:\n    enabled: true\n    file: notes.md\n    stall_steps: 3\n"), 0644))
+
+	cfg, err := Load(tmpfile)
+	require.NoError(t, err)
+	require.True(t, cfg.Input.Progress.Enabled)
+	require.Equal(t, "notes.md", cfg.Input.Progress.File)
+	require.Equal(t, 3, cfg.Input.Progress.StallSteps)
+
+	require.NoError(t, os.WriteFile(tmpfile, []byte("input:\n  progress:\n    stall_steps: -1\n"), 0644))
+	_, err = Load(tmpfile)
+	require.ErrorContains(t, err, "invalid progress.stall_steps")
+}
@@ -0,0 +1,124 @@
+// Package events reports the progress of a loop as newline-delimited JSON,
+// one event per line, so other tools can follow a run.
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/eduardolat/clancy/internal/loop"
+)
+
+// Event types.
+const (
+	TypeRunStarted      = "run_started"
+	TypeStepStarted     = "step_started"
+	TypeStepOutputChunk = "step_output_chunk"
+	TypeStepFinished    = "step_finished"
+	TypeCooldown        = "cooldown"
+	TypeRunFinished     = "run_finished"
+)
+
+// Reasons for a cooldown event.
+const (
+	CooldownDelay   = "delay"   // loop.delay between steps
+	CooldownBackoff = "backoff" // A backoff rule matched
+)
+
+// Event is a single line of the stream. Only the fields relevant to its type
+// are set. Durations are in milliseconds.
+type Event struct {
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	RunID       string    `json:"run_id,omitempty"`
+	Step        int       `json:"step,omitempty"`
+	FirstStep   int       `json:"first_step,omitempty"`
+	MaxSteps    int       `json:"max_steps,omitempty"`
+	TimeoutMS   int64     `json:"timeout_ms,omitempty"`
+	Data        string    `json:"data,omitempty"`
+	Status      string    `json:"status,omitempty"`
+	ExitCode    *int      `json:"exit_code,omitempty"`
+	DurationMS  *int64    `json:"duration_ms,omitempty"`
+	StopMatched *bool     `json:"stop_matched,omitempty"`
+	DelayMS     int64     `json:"delay_ms,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Writer is a loop.Observer that encodes the main notifications as Events.
+// Write errors are ignored, reporting must never stop the loop.
+type Writer struct {
+	loop.NopObserver
+
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+var _ loop.Observer = (*Writer)(nil)
+
+// NewWriter creates a Writer that emits events to w.
+func NewWriter(w io.Writer) *Writer {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &Writer{enc: enc}
+}
+
+func (w *Writer) emit(e Event) {
+	e.Time = time.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_ = w.enc.Encode(e)
+}
+
+func (w *Writer) OnRunStart(info loop.RunInfo) {
+	w.emit(Event{
+		Type:      TypeRunStarted,
+		RunID:     info.RunID,
+		FirstStep: info.FirstStep,
+		MaxSteps:  info.MaxSteps,
+		TimeoutMS: info.Timeout.Milliseconds(),
+	})
+}
+
+func (w *Writer) OnStepStart(step int) {
+	w.emit(Event{Type: TypeStepStarted, Step: step})
+}
+
+func (w *Writer) OnStepOutput(step int, data []byte) {
+	w.emit(Event{Type: TypeStepOutputChunk, Step: step, Data: string(data)})
+}
+
+func (w *Writer) OnStepEnd(res loop.StepResult, stopMatched bool) {
+	duration := res.Duration.Milliseconds()
+	e := Event{
+		Type:        TypeStepFinished,
+		Step:        res.Step,
+		Status:      string(res.Status),
+		ExitCode:    &res.ExitCode,
+		DurationMS:  &duration,
+		StopMatched: &stopMatched,
+	}
+	if res.Err != nil {
+		e.Error = res.Err.Error()
+	}
+	w.emit(e)
+}
+
+func (w *Writer) OnCooldown(step int, delay time.Duration) {
+	w.emit(Event{Type: TypeCooldown, Step: step, DelayMS: delay.Milliseconds(), Reason: CooldownDelay})
+}
+
+func (w *Writer) OnBackoff(step, rule, attempt int, delay time.Duration) {
+	w.emit(Event{Type: TypeCooldown, Step: step, DelayMS: delay.Milliseconds(), Reason: CooldownBackoff})
+}
+
+func (w *Writer) OnRunEnd(summary loop.RunSummary) {
+	e := Event{Type: TypeRunFinished, Reason: summary.Reason}
+	if summary.Err != nil {
+		e.Error = summary.Err.Error()
+	}
+	w.emit(e)
+}
@@ -0,0 +1,62 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eduardolat/clancy/internal/loop"
+	"github.com/stretchr/testify/require"
+)
+
+func decode(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var out []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &e))
+		out = append(out, e)
+	}
+	return out
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	w.OnRunStart(loop.RunInfo{RunID: "abc", FirstStep: 1, MaxSteps: 5, Timeout: time.Minute})
+	w.OnStepStart(1)
+	w.OnStepOutput(1, []byte("<b>hi</b>\n"))
+	w.OnStepEnd(loop.StepResult{Step: 1, Status: loop.StepCompleted, Duration: 1500 * time.Millisecond}, false)
+	w.OnCooldown(1, 2*time.Second)
+	w.OnBackoff(1, 1, 1, time.Minute)
+	w.OnRetry(1) // Not reported
+	w.OnRunEnd(loop.RunSummary{Reason: loop.ReasonMaxSteps, Err: errors.New("max steps (5) reached without success")})
+
+	events := decode(t, &buf)
+	require.Len(t, events, 7)
+
+	require.Equal(t, TypeRunStarted, events[0]["type"])
+	require.Equal(t, "abc", events[0]["run_id"])
+	require.EqualValues(t, 60000, events[0]["timeout_ms"])
+
+	require.Equal(t, TypeStepOutputChunk, events[2]["type"])
+	require.Equal(t, "<b>hi</b>\n", events[2]["data"])
+
+	// Zero values that matter are still present.
+	require.Equal(t, TypeStepFinished, events[3]["type"])
+	require.EqualValues(t, 0, events[3]["exit_code"])
+	require.Equal(t, false, events[3]["stop_matched"])
+	require.EqualValues(t, 1500, events[3]["duration_ms"])
+
+	require.EqualValues(t, 2000, events[4]["delay_ms"])
+	require.Equal(t, CooldownDelay, events[4]["reason"])
+	require.Equal(t, CooldownBackoff, events[5]["reason"])
+
+	require.Equal(t, TypeRunFinished, events[6]["type"])
+	require.Equal(t, loop.ReasonMaxSteps, events[6]["reason"])
+	require.Contains(t, events[6]["error"], "max steps")
+}
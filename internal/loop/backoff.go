@@ -0,0 +1,181 @@
+package loop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eduardolat/clancy/internal/ansi"
+	"github.com/eduardolat/clancy/internal/config"
+)
+
+// untilLayouts are the time formats understood in the capture group of a
+// backoff rule's until pattern. Layouts without a date refer to the next
+// occurrence of that time of day.
+var untilLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"15:04:05",
+	"15:04",
+	"3:04pm",
+	"3:04 pm",
+	"3pm",
+	"3 pm",
+}
+
+// maxBackoffDelay caps exponential delays of rules without max, long before
+// doubling overflows.
+const maxBackoffDelay = time.Hour
+
+// backoffState tracks consecutive matches per backoff rule, so exponential
+// delays grow while the agent keeps hitting the same limit.
+type backoffState struct {
+	attempts map[int]int
+}
+
+func newBackoffState() *backoffState {
+	return &backoffState{attempts: map[int]int{}}
+}
+
+// match returns the first rule matching output, its index and the number of
+// consecutive times it matched, including this one. When nothing matches the
+// counters are reset and the index is -1.
+func (b *backoffState) match(rules []config.BackoffRule, output string) (config.BackoffRule, int, int) {
+	for i, rule := range rules {
+		if rule.Regexp != nil && rule.Regexp.MatchString(output) {
+			b.attempts[i]++
+			return rule, i, b.attempts[i]
+		}
+	}
+	clear(b.attempts)
+	return config.BackoffRule{}, -1, 0
+}
+
+// backoffDelay computes how long to wait for a matched rule. A time found by
+// the until pattern wins over the strategy; MaxDuration caps the result.
+func backoffDelay(rule config.BackoffRule, attempt int, output string, now time.Time) time.Duration {
+	delay := rule.DelayDuration
+	if rule.Strategy == config.BackoffExponential {
+		limit := rule.MaxDuration
+		if limit == 0 {
+			limit = maxBackoffDelay
+		}
+		for i := 1; i < attempt && delay < limit; i++ {
+			delay *= 2
+		}
+		delay = min(delay, limit)
+	}
+
+	if rule.UntilRegexp != nil {
+		if m := rule.UntilRegexp.FindStringSubmatch(output); m != nil {
+			if until, ok := parseUntil(m[1], now); ok {
+				delay = until.Sub(now)
+			}
+		}
+	}
+
+	if rule.MaxDuration > 0 && delay > rule.MaxDuration {
+		delay = rule.MaxDuration
+	}
+	return max(delay, 0)
+}
+
+// parseUntil turns the text captured by an until pattern into an absolute
+// time. It accepts Unix timestamps and the layouts in untilLayouts.
+func parseUntil(s string, now time.Time) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil && len(s) >= 9 {
+		return time.Unix(secs, 0), true
+	}
+
+	for _, layout := range untilLayouts {
+		// The am/pm layouts only accept lower case.
+		t, err := time.ParseInLocation(layout, s, now.Location())
+		if err != nil {
+			t, err = time.ParseInLocation(layout, strings.ToLower(s), now.Location())
+		}
+		if err != nil {
+			continue
+		}
+		if t.Year() != 0 {
+			return t, true
+		}
+
+		// Time of day only: use the next occurrence.
+		t = time.Date(now.Year(), now.Month(), now.Day(),
+			t.Hour(), t.Minute(), t.Second(), 0, now.Location())
+		if t.Before(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, true
+	}
+
+	return time.Time{}, false
+}
+
+// cooldown is the wait a matching backoff rule asks for.
+type cooldown struct {
+	rule    int // 1-based index of the rule
+	attempt int
+	delay   time.Duration
+}
+
+// matchBackoff checks the step output against the backoff rules. It reports
+// whether one matched, in which case the step must be repeated once the
+// cooldown is waited out.
+func matchBackoff(cfg *config.Config, state *backoffState, res StepResult) (cooldown, bool) {
+	if res.Status != StepCompleted || len(cfg.Loop.Backoff) == 0 {
+		return cooldown{}, false
+	}
+
+	output := ansi.Strip(res.Output)
+	rule, index, attempt := state.match(cfg.Loop.Backoff, output)
+	if index < 0 {
+		return cooldown{}, false
+	}
+	return cooldown{rule: index + 1, attempt: attempt, delay: backoffDelay(rule, attempt, output, time.Now())}, true
+}
+
+// backoff waits out the cooldown c after step. A stop requested through the
+// control cuts the wait short.
+func backoff(ctx context.Context, o *options, step int, c cooldown) error {
+	o.notify(func(obs Observer) { obs.OnBackoff(step, c.rule, c.attempt, c.delay) })
+	if err := countdown(ctx, o, step, c.delay); err != nil {
+		if errors.Is(err, ErrInterrupted) {
+			return err
+		}
+		return fmt.Errorf("%w during backoff", ErrTimeout)
+	}
+	return nil
+}
+
+// countdown waits for d, reporting the remaining time every second.
+func countdown(ctx context.Context, o *options, step int, d time.Duration) error {
+	deadline := time.Now().Add(d)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		remaining := max(time.Until(deadline), 0)
+		o.notify(func(obs Observer) { obs.OnBackoffTick(step, remaining) })
+		if remaining <= 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-o.control.Stopping():
+			return ErrInterrupted
+		case <-o.control.skipped():
+			return nil
+		case <-ticker.C:
+		case <-time.After(time.Until(deadline)):
+		}
+	}
+}
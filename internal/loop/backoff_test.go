@@ -0,0 +1,169 @@
+package loop
+
+import (
+	"context"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/eduardolat/clancy/internal/config"
+	"github.com/eduardolat/clancy/internal/runs"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	now := time.Date(2025, 6, 1, 14, 30, 0, 0, time.UTC)
+
+	exponential := config.BackoffRule{
+		Strategy:      config.BackoffExponential,
+		DelayDuration: 30 * time.Second,
+		MaxDuration:   time.Minute + 30*time.Second,
+	}
+	require.Equal(t, 30*time.Second, backoffDelay(exponential, 1, "", now))
+	require.Equal(t, time.Minute, backoffDelay(exponential, 2, "", now))
+	require.Equal(t, time.Minute+30*time.Second, backoffDelay(exponential, 3, "", now)) // Capped
+	require.Equal(t, time.Minute+30*time.Second, backoffDelay(exponential, 60, "", now))
+
+	// Without max, doubling stops at maxBackoffDelay instead of overflowing.
+	exponential.MaxDuration = 0
+	require.Equal(t, maxBackoffDelay, backoffDelay(exponential, 100, "", now))
+
+	fixed := config.BackoffRule{Strategy: config.BackoffFixed, DelayDuration: 10 * time.Second}
+	require.Equal(t, 10*time.Second, backoffDelay(fixed, 5, "", now))
+
+	until := config.BackoffRule{
+		Strategy:      config.BackoffFixed,
+		DelayDuration: 10 * time.Second,
+		MaxDuration:   3 * time.Hour,
+		UntilRegexp:   regexp.MustCompile(`resets at (\S+)`),
+	}
+	require.Equal(t, 30*time.Minute, backoffDelay(until, 1, "usage limit reached, resets at 3pm", now))
+	require.Equal(t, 3*time.Hour, backoffDelay(until, 1, "resets at 9am", now)) // Tomorrow, capped
+	require.Equal(t, 10*time.Second, backoffDelay(until, 1, "resets at soon", now))
+}
+
+func TestParseUntil(t *testing.T) {
+	now := time.Date(2025, 6, 1, 14, 30, 0, 0, time.UTC)
+
+	tests := map[string]time.Time{
+		"3pm":                  time.Date(2025, 6, 1, 15, 0, 0, 0, time.UTC),
+		"3:45 PM":              time.Date(2025, 6, 1, 15, 45, 0, 0, time.UTC),
+		"14:00":                time.Date(2025, 6, 2, 14, 0, 0, 0, time.UTC),
+		"2025-06-01T18:00:00Z": time.Date(2025, 6, 1, 18, 0, 0, 0, time.UTC),
+		"1748790000":           time.Unix(1748790000, 0),
+	}
+	for input, expected := range tests {
+		got, ok := parseUntil(input, now)
+		require.True(t, ok, input)
+		require.True(t, expected.Equal(got), "%s: expected %s, got %s", input, expected, got)
+	}
+
+	_, ok := parseUntil("later", now)
+	require.False(t, ok)
+}
+
+func TestRun_Backoff(t *testing.T) {
+	// Scenario: Two rate limited invocations do not use up the two steps.
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:        2,
+			StopPhrase:      "DONE",
+			TimeoutDuration: time.Minute,
+			Backoff: []config.BackoffRule{{
+				Pattern:       "(?i)rate limit",
+				Strategy:      config.BackoffFixed,
+				Delay:         "10ms",
+				Regexp:        regexp.MustCompile("(?i)rate limit"),
+				DelayDuration: 10 * time.Millisecond,
+			}},
+		},
+	}
+
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("Error: Rate limit exceeded", exitError(t, 1)).Twice()
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("working", nil).Once()
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("DONE", nil).Once()
+
+	require.NoError(t, Run(context.Background(), cfg, mockRunner, "p"))
+	mockRunner.AssertExpectations(t)
+}
+
+func TestRun_Backoff_GlobalTimeout(t *testing.T) {
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:        2,
+			StopPhrase:      "DONE",
+			TimeoutDuration: 100 * time.Millisecond,
+			Backoff: []config.BackoffRule{{
+				Pattern:       "rate limit",
+				Strategy:      config.BackoffFixed,
+				Regexp:        regexp.MustCompile("rate limit"),
+				DelayDuration: time.Hour,
+			}},
+		},
+	}
+
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("rate limit", nil).Once()
+
+	start := time.Now()
+	err := Run(context.Background(), cfg, mockRunner, "p")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "global timeout reached during backoff")
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+// backoffStopper saves what the run directory holds once the cooldown starts
+// and asks the loop to stop.
+type backoffStopper struct {
+	NopObserver
+	run     *runs.Run
+	control *Control
+	saved   runs.State
+}
+
+func (b *backoffStopper) OnBackoff(step, rule, attempt int, delay time.Duration) {
+	saved, err := runs.Open(filepath.Dir(b.run.Dir), b.run.State.ID)
+	if err == nil {
+		b.saved = saved.State
+	}
+	b.control.Stop()
+}
+
+func TestRun_Backoff_Checkpoint(t *testing.T) {
+	// The rate limited step is repeated when the run is resumed, whether the
+	// cooldown was interrupted or Clancy crashed during it.
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:   5,
+			StopPhrase: "DONE",
+			Backoff: []config.BackoffRule{{
+				Pattern:       "rate limit",
+				Strategy:      config.BackoffFixed,
+				Regexp:        regexp.MustCompile("rate limit"),
+				DelayDuration: time.Hour,
+			}},
+		},
+	}
+	run, err := runs.Create(t.TempDir(), runs.State{})
+	require.NoError(t, err)
+
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("rate limit", nil).Once()
+
+	ctrl := NewControl()
+	obs := &backoffStopper{run: run, control: ctrl}
+	err = Run(context.Background(), cfg, mockRunner, "p", WithRun(run), WithControl(ctrl), WithObservers(obs))
+	require.ErrorIs(t, err, ErrInterrupted)
+	require.Equal(t, 1, obs.saved.NextStep, "saved before the cooldown")
+
+	saved, err := runs.Open(filepath.Dir(run.Dir), run.State.ID)
+	require.NoError(t, err)
+	require.Equal(t, runs.StatusInterrupted, saved.State.Status)
+	require.Equal(t, 1, saved.State.NextStep)
+}
@@ -0,0 +1,108 @@
+package loop
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is wrapped by the errors Run returns when the global timeout
+// expired.
+var ErrTimeout = errors.New("global timeout reached")
+
+// budget enforces the global timeout. Unlike context.WithTimeout, the clock
+// can be frozen, e.g. while the loop is paused.
+type budget struct {
+	mu        sync.Mutex
+	timer     *time.Timer // nil when there is no timeout
+	timeout   time.Duration
+	deadline  time.Time
+	remaining time.Duration // Time left when frozen
+	stopped   bool          // The timer was stopped by freeze
+	start     time.Time
+	frozenAt  time.Time     // Zero unless frozen
+	frozenFor time.Duration // Total of the earlier frozen periods
+}
+
+// withBudget returns a context that is cancelled once timeout has elapsed,
+// not counting frozen periods. A zero timeout means no limit. The returned
+// function releases the resources and must be called when done.
+func withBudget(ctx context.Context, timeout time.Duration) (context.Context, *budget, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	b := &budget{start: time.Now(), timeout: max(timeout, 0)}
+
+	if timeout > 0 {
+		b.deadline = b.start.Add(timeout)
+		b.timer = time.AfterFunc(timeout, func() {
+			cancel(context.DeadlineExceeded)
+		})
+	}
+
+	return ctx, b, func() {
+		if b.timer != nil {
+			b.timer.Stop()
+		}
+		cancel(context.Canceled)
+	}
+}
+
+// freeze stops the clock until thaw is called.
+func (b *budget) freeze() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.frozenAt.IsZero() {
+		return
+	}
+	b.frozenAt = time.Now()
+	if b.timer != nil && b.timer.Stop() {
+		b.remaining = time.Until(b.deadline)
+		b.stopped = true
+	}
+}
+
+// thaw restarts a frozen clock with the time that was left.
+func (b *budget) thaw() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.frozenAt.IsZero() {
+		return
+	}
+	b.frozenFor += time.Since(b.frozenAt)
+	b.frozenAt = time.Time{}
+	if b.stopped {
+		b.deadline = time.Now().Add(b.remaining)
+		b.timer.Reset(b.remaining)
+		b.stopped = false
+	}
+}
+
+// left returns the time left before the timeout, zero without one.
+func (b *budget) left() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.timer == nil:
+		return 0
+	case b.stopped:
+		return b.remaining
+	default:
+		return max(time.Until(b.deadline), 0)
+	}
+}
+
+// elapsed returns the time the clock ran, frozen periods excluded.
+func (b *budget) elapsed() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	d := now.Sub(b.start) - b.frozenFor
+	if !b.frozenAt.IsZero() {
+		d -= now.Sub(b.frozenAt)
+	}
+	return d
+}
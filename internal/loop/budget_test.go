@@ -0,0 +1,57 @@
+package loop
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBudget_Expires(t *testing.T) {
+	ctx, _, cancel := withBudget(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+		require.ErrorIs(t, context.Cause(ctx), context.DeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("budget did not expire")
+	}
+}
+
+func TestBudget_NoTimeout(t *testing.T) {
+	ctx, clock, cancel := withBudget(context.Background(), 0)
+	clock.freeze() // Only the elapsed time is frozen without a timer
+	clock.thaw()
+	require.NoError(t, ctx.Err())
+
+	cancel()
+	require.Error(t, ctx.Err())
+}
+
+func TestBudget_Freeze(t *testing.T) {
+	ctx, clock, cancel := withBudget(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	clock.freeze()
+	time.Sleep(200 * time.Millisecond)
+	require.NoError(t, ctx.Err(), "frozen budget must not expire")
+
+	clock.thaw()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("budget did not expire after thaw")
+	}
+}
+
+func TestBudget_Elapsed(t *testing.T) {
+	_, clock, cancel := withBudget(context.Background(), 0)
+	defer cancel()
+
+	clock.freeze()
+	time.Sleep(200 * time.Millisecond)
+	clock.thaw()
+	require.Less(t, clock.elapsed(), 100*time.Millisecond, "frozen time must not count")
+}
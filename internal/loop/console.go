@@ -0,0 +1,243 @@
+package loop
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/eduardolat/clancy/internal/config"
+)
+
+// ANSI Color Codes
+const (
+	colorReset  = "\033[0m"
+	colorCyan   = "\033[36m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorRed    = "\033[31m"
+)
+
+// boxLine is the heavy rule drawn above and below every box.
+const boxLine = "━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━"
+
+// Console is the Observer behind Clancy's terminal output: colored boxes for
+// every event and the window title for passive monitoring. The agent output
+// itself is streamed by the runner, not by the Console.
+type Console struct {
+	out      io.Writer // Progress
+	err      io.Writer // Failures
+	maxSteps int
+	inline   bool     // A countdown line is waiting for its newline
+	reload   []string // Notice for the next header
+}
+
+var _ Observer = (*Console)(nil)
+
+// NewConsole creates a Console that writes progress to out and failures to
+// errOut, usually os.Stdout and os.Stderr.
+func NewConsole(out, errOut io.Writer) *Console {
+	return &Console{out: out, err: errOut}
+}
+
+// title updates the terminal window title.
+func (con *Console) title(s string) {
+	_, _ = fmt.Fprintf(con.out, "\033]0;%s\007", s)
+}
+
+// endLine terminates a pending countdown line before anything else is
+// printed.
+func (con *Console) endLine() {
+	if con.inline {
+		_, _ = fmt.Fprintln(con.out)
+		con.inline = false
+	}
+}
+
+// box prints lines framed by heavy rules in color. A leading blank line
+// separates it from agent output when spaced is set.
+func (con *Console) box(w io.Writer, color string, spaced bool, lines ...string) {
+	con.endLine()
+	r := colorReset
+	if spaced {
+		_, _ = fmt.Fprintln(w)
+	}
+	_, _ = fmt.Fprintf(w, "%s%s%s\n", color, boxLine, r)
+	for _, line := range lines {
+		_, _ = fmt.Fprintf(w, "%s  %s%s\n", color, line, r)
+	}
+	_, _ = fmt.Fprintf(w, "%s%s%s\n", color, boxLine, r)
+}
+
+func (con *Console) OnRunStart(info RunInfo) {
+	con.maxSteps = info.MaxSteps
+}
+
+// OnReload adds what input.reload changed to the next header.
+func (con *Console) OnReload(step int, reload Reload) {
+	con.reload = []string{"", "📝 Reloaded: " + reload.String()}
+	for _, line := range reload.Diff {
+		con.reload = append(con.reload, fmt.Sprintf("%.60s", line))
+	}
+}
+
+// OnStepStart prints the header. HEADER (Cyan Box)
+func (con *Console) OnStepStart(step int) {
+	con.endLine()
+	if step > 1 {
+		_, _ = fmt.Fprint(con.out, "\n\n") // Visual separation from previous step
+	}
+
+	// Update Window Title (Passive Monitoring)
+	con.title(fmt.Sprintf("🍩 Clancy: Step %d/%d", step, con.maxSteps))
+
+	// Heavy box style for high visibility
+	lines := append([]string{fmt.Sprintf("🍩 CLANCY: STEP %02d/%02d", step, con.maxSteps)}, con.reload...)
+	con.reload = nil
+	con.box(con.out, colorCyan, false, lines...)
+	_, _ = fmt.Fprintln(con.out) // Blank line BEFORE agent output
+}
+
+func (con *Console) OnStepOutput(step int, data []byte) {}
+
+func (con *Console) OnStepEnd(res StepResult, stopMatched bool) {
+	_, _ = fmt.Fprintln(con.out) // Blank line AFTER agent output
+}
+
+// OnStepTimeout reports a step killed by the step timeout. STEP TIMEOUT (Yellow Box)
+func (con *Console) OnStepTimeout(step int, timeout time.Duration) {
+	con.box(con.out, colorYellow, false, fmt.Sprintf("⏰ CLANCY: Step %02d timed out after %s. Agent stopped.", step, timeout))
+}
+
+// OnIdleTimeout reports a step killed for being silent. IDLE TIMEOUT (Yellow Box)
+func (con *Console) OnIdleTimeout(step int, timeout time.Duration) {
+	con.box(con.out, colorYellow, false, fmt.Sprintf("💤 CLANCY: Step %02d produced no output for %s. Agent stopped.", step, timeout))
+}
+
+// OnStepError reports an agent that failed to run. CRITICAL ERROR (Red Box)
+func (con *Console) OnStepError(step int, err error) {
+	// Truncate to 55 chars to allow for "..."
+	con.box(con.err, colorRed, false, "💥 CLANCY: Agent execution failed!", fmt.Sprintf("%.55s...", err.Error()))
+}
+
+// OnAbort reports an abort phrase. ABORT (Red Box)
+func (con *Console) OnAbort(step int, phrase string) {
+	con.box(con.err, colorRed, false,
+		fmt.Sprintf("🛑 CLANCY: Agent gave up in step %02d!", step),
+		fmt.Sprintf("Abort phrase found: %.40s", phrase))
+}
+
+// OnCircuitBreaker reports too many consecutive failures. CIRCUIT BREAKER (Red Box)
+func (con *Console) OnCircuitBreaker(failures int) {
+	con.box(con.err, colorRed, false, fmt.Sprintf("🧯 CLANCY: Agent failed %d times in a row. Giving up!", failures))
+}
+
+// OnNoProgress reports a progress file that stopped changing. NO PROGRESS (Red Box)
+func (con *Console) OnNoProgress(step, steps int) {
+	con.box(con.err, colorRed, false, fmt.Sprintf("🐌 CLANCY: Progress file unchanged for %d steps. Giving up!", steps))
+}
+
+// OnExitCode reports a matched on_exit_code rule.
+func (con *Console) OnExitCode(step, code int, action string) {
+	color, w, verdict := colorYellow, con.out, "asks for a retry. Repeating step..."
+	switch action {
+	case config.ExitActionSucceed:
+		color, verdict = colorGreen, "means success."
+	case config.ExitActionFail:
+		color, w, verdict = colorRed, con.err, "is fatal. Stopping!"
+	}
+	con.box(w, color, false, fmt.Sprintf("🚦 CLANCY: Exit code %d in step %02d %s", code, step, verdict))
+}
+
+// OnVerify announces the verification command. VERIFY (Cyan Box)
+func (con *Console) OnVerify(step int, command string) {
+	con.box(con.out, colorCyan, false, fmt.Sprintf("🔍 CLANCY: Stop phrase found. Verifying: %.40s", command))
+	_, _ = fmt.Fprintln(con.out)
+}
+
+// OnVerifyEnd reports a failed verification. VERIFICATION FAILED (Red Box)
+func (con *Console) OnVerifyEnd(step int, err error) {
+	_, _ = fmt.Fprintln(con.out)
+	if err != nil {
+		con.box(con.err, colorRed, false, fmt.Sprintf("❌ CLANCY: Verification of step %02d failed (%.30s). Continuing...", step, err.Error()))
+	}
+}
+
+// OnStopFound reports success. SUCCESS (Green Box)
+func (con *Console) OnStopFound(step int) {
+	con.box(con.out, colorGreen, false, fmt.Sprintf("✅ CLANCY: Stop phrase found in step %02d", step))
+}
+
+// OnRetry reports a step without the stop phrase. RETRY (Yellow Box)
+func (con *Console) OnRetry(step int) {
+	con.box(con.out, colorYellow, false, fmt.Sprintf("🔄 CLANCY: Stop phrase NOT found in step %02d. Continuing...", step))
+}
+
+// OnCooldown announces the delay between steps. COOLDOWN (Yellow Box)
+func (con *Console) OnCooldown(step int, delay time.Duration) {
+	con.box(con.out, colorYellow, true, fmt.Sprintf("⏳ CLANCY: Waiting %s before next step...", delay))
+}
+
+// OnBackoff announces a backoff cooldown. BACKOFF (Yellow Box)
+func (con *Console) OnBackoff(step, rule, attempt int, delay time.Duration) {
+	con.box(con.out, colorYellow, true,
+		fmt.Sprintf("🧊 CLANCY: Backoff rule %d matched in step %02d (attempt %d).", rule, step, attempt),
+		fmt.Sprintf("Cooling down for %s. This step will be repeated.", delay.Round(time.Second)))
+}
+
+// OnBackoffTick refreshes the remaining backoff time on a single line.
+func (con *Console) OnBackoffTick(step int, remaining time.Duration) {
+	_, _ = fmt.Fprintf(con.out, "\r\033[K%s  ⏳ Resuming in %s%s", colorYellow, remaining.Round(time.Second), colorReset)
+	con.inline = true
+}
+
+// OnPause reports a pause between steps. PAUSE (Yellow Box)
+func (con *Console) OnPause(step int, frozen bool) {
+	clock := "keeps running"
+	if frozen {
+		clock = "is frozen"
+	}
+	con.title(fmt.Sprintf("⏸️ Clancy: Paused before step %d/%d", step, con.maxSteps))
+	con.box(con.out, colorYellow, true,
+		fmt.Sprintf("⏸️  CLANCY: Paused before step %02d. Waiting to be resumed...", step),
+		fmt.Sprintf("The global timeout %s.", clock))
+}
+
+// OnResume reports the end of a pause. RESUMED (Green Box)
+func (con *Console) OnResume(step int) {
+	con.box(con.out, colorGreen, false, "▶️  CLANCY: Resumed")
+}
+
+func (con *Console) OnWarning(err error) {
+	con.endLine()
+	_, _ = fmt.Fprintf(con.err, ">>> [Clancy] Warning: %v\n", err)
+}
+
+// OnRunEnd updates the window title and, when the run was interrupted,
+// prints a summary. SUMMARY (Cyan Box)
+func (con *Console) OnRunEnd(summary RunSummary) {
+	con.endLine()
+	switch summary.Reason {
+	case ReasonSuccess:
+		con.title("✅ Clancy: Done")
+	case ReasonAborted:
+		con.title("🛑 Clancy: Aborted")
+	case ReasonInterrupted:
+		con.box(con.out, colorCyan, true,
+			"✋ CLANCY: Interrupted",
+			fmt.Sprintf("Steps run: %d | Elapsed: %s", summary.Steps, summary.Elapsed.Round(time.Second)),
+			fmt.Sprintf("Last status: %s", describeStep(summary.Steps, summary.Last)))
+		con.title("✋ Clancy: Interrupted")
+	}
+}
+
+// describeStep summarizes the last finished step for the summary box.
+func describeStep(stepsRun int, res StepResult) string {
+	if stepsRun == 0 {
+		return "no step finished"
+	}
+	desc := fmt.Sprintf("step %02d %s", res.Step, res.Status)
+	if res.ExitCode != 0 {
+		desc += fmt.Sprintf(" (exit code %d)", res.ExitCode)
+	}
+	return desc
+}
@@ -0,0 +1,42 @@
+package loop
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eduardolat/clancy/internal/ansi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsole(t *testing.T) {
+	var out, errOut bytes.Buffer
+	con := NewConsole(&out, &errOut)
+
+	con.OnRunStart(RunInfo{FirstStep: 1, MaxSteps: 10})
+	con.OnStepStart(3)
+	require.Contains(t, out.String(), "\033]0;🍩 Clancy: Step 3/10\007")
+	require.Contains(t, ansi.Strip(out.String()), "CLANCY: STEP 03/10")
+
+	// What input.reload changed goes in the next header.
+	out.Reset()
+	con.OnReload(4, Reload{Prompt: true, Diff: []string{"- Fix the parser.", "+ Fix the lexer."}})
+	con.OnStepStart(4)
+	require.Contains(t, ansi.Strip(out.String()), "CLANCY: STEP 04/10\n  \n  📝 Reloaded: prompt\n  - Fix the parser.\n  + Fix the lexer.\n━")
+
+	con.OnStepError(3, errors.New("exec: not found"))
+	require.Contains(t, ansi.Strip(errOut.String()), "Agent execution failed!\n  exec: not found...")
+
+	// A countdown line is terminated before the next box.
+	out.Reset()
+	con.OnBackoffTick(3, 2*time.Second)
+	con.OnRetry(3)
+	require.Contains(t, ansi.Strip(out.String()), "Resuming in 2s\n━")
+
+	out.Reset()
+	con.OnRunEnd(RunSummary{Reason: ReasonInterrupted, Steps: 1, Elapsed: 90 * time.Second, Last: StepResult{Step: 3, Status: StepCompleted, ExitCode: 2}})
+	summary := ansi.Strip(out.String())
+	require.Contains(t, summary, "Steps run: 1 | Elapsed: 1m30s")
+	require.Contains(t, summary, "Last status: step 03 completed (exit code 2)")
+}
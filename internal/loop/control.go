@@ -0,0 +1,179 @@
+package loop
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrInterrupted is returned by Run when the loop was stopped on request,
+// e.g. after the user pressed Ctrl-C.
+var ErrInterrupted = errors.New("interrupted")
+
+// Control lets other goroutines, such as signal handlers, steer a running
+// loop. All methods are safe for concurrent use, and a nil *Control is valid
+// and never requests anything.
+type Control struct {
+	mu       sync.Mutex
+	stopping chan struct{}
+	resumed  chan struct{} // Closed on Resume, nil when not paused
+	skip     chan struct{} // Unbuffered, only received while waiting
+	clock    *budget       // Global timeout of the running loop
+	spent    time.Duration // Elapsed in previous sessions of the run
+}
+
+// NewControl creates a Control for a single Run.
+func NewControl() *Control {
+	return &Control{stopping: make(chan struct{}), skip: make(chan struct{})}
+}
+
+// Stop asks the loop to end after the current step. Calling it more than
+// once has no further effect.
+func (c *Control) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.stopping:
+	default:
+		close(c.stopping)
+	}
+}
+
+// Stopping returns a channel that is closed once Stop has been called.
+func (c *Control) Stopping() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	return c.stopping
+}
+
+// stopRequested reports whether Stop has been called.
+func (c *Control) stopRequested() bool {
+	select {
+	case <-c.Stopping():
+		return true
+	default:
+		return false
+	}
+}
+
+// SkipDelay cuts the current wait between steps short: the delay or a
+// backoff cooldown. It reports whether the loop was waiting.
+func (c *Control) SkipDelay() bool {
+	select {
+	case c.skip <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// skipped returns a channel that receives SkipDelay requests.
+func (c *Control) skipped() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	return c.skip
+}
+
+// attach lets the control report on the global timeout of the loop, which
+// ran for spent in previous sessions of the run.
+func (c *Control) attach(clock *budget, spent time.Duration) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock, c.spent = clock, spent
+}
+
+// Elapsed returns the time the run has been going, previous sessions
+// included and frozen pauses excluded, like the run state. It reports false
+// before the loop starts.
+func (c *Control) Elapsed() (time.Duration, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.Lock()
+	clock, spent := c.clock, c.spent
+	c.mu.Unlock()
+	if clock == nil {
+		return 0, false
+	}
+	return spent + clock.elapsed(), true
+}
+
+// Remaining returns what is left of the global timeout, frozen pauses
+// excluded. It reports false before the loop starts and when it has no
+// timeout.
+func (c *Control) Remaining() (time.Duration, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.Lock()
+	clock := c.clock
+	c.mu.Unlock()
+	if clock == nil || clock.timer == nil {
+		return 0, false
+	}
+	return clock.left(), true
+}
+
+// Timeout returns the global timeout of the run, previous sessions
+// included. It reports false before the loop starts and when it has no
+// timeout.
+func (c *Control) Timeout() (time.Duration, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.clock == nil || c.clock.timer == nil {
+		return 0, false
+	}
+	return c.spent + c.clock.timeout, true
+}
+
+// Pause asks the loop to wait before starting the next step. The current
+// step, if any, is not affected.
+func (c *Control) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.resumed == nil {
+		c.resumed = make(chan struct{})
+	}
+}
+
+// Resume lets a paused loop continue.
+func (c *Control) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.resumed != nil {
+		close(c.resumed)
+		c.resumed = nil
+	}
+}
+
+// Paused reports whether a pause is in effect.
+func (c *Control) Paused() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resumed != nil
+}
+
+// Resumed returns a channel that is closed when the current pause ends. It
+// returns nil when the loop is not paused.
+func (c *Control) Resumed() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resumed
+}
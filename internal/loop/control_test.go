@@ -0,0 +1,231 @@
+package loop
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/eduardolat/clancy/internal/config"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControl_Nil(t *testing.T) {
+	var c *Control
+	require.Nil(t, c.Stopping())
+	require.False(t, c.stopRequested())
+	_, ok := c.Remaining()
+	require.False(t, ok)
+	_, ok = c.Elapsed()
+	require.False(t, ok)
+}
+
+func TestControl_Remaining(t *testing.T) {
+	c := NewControl()
+	_, ok := c.Remaining()
+	require.False(t, ok, "no loop attached yet")
+
+	_, clock, cancel := withBudget(context.Background(), time.Hour)
+	defer cancel()
+	c.attach(clock, time.Minute)
+	left, ok := c.Remaining()
+	require.True(t, ok)
+	require.LessOrEqual(t, left, time.Hour)
+
+	// Frozen time is not taken from the budget.
+	clock.freeze()
+	frozen, _ := c.Remaining()
+	time.Sleep(10 * time.Millisecond)
+	left, _ = c.Remaining()
+	require.Equal(t, frozen, left)
+
+	// Previous sessions count as elapsed.
+	elapsed, ok := c.Elapsed()
+	require.True(t, ok)
+	require.GreaterOrEqual(t, elapsed, time.Minute)
+	later, _ := c.Elapsed()
+	require.Equal(t, elapsed, later)
+	timeout, ok := c.Timeout()
+	require.True(t, ok)
+	require.Equal(t, time.Hour+time.Minute, timeout)
+}
+
+func TestRun_Stop_FinishesCurrentStep(t *testing.T) {
+	// Scenario: Stop is requested while the first step runs. The step must
+	// complete and no further step may start.
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:        5,
+			StopPhrase:      "DONE",
+			TimeoutDuration: time.Minute,
+		},
+	}
+
+	ctrl := NewControl()
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Run(func(args mock.Arguments) {
+		ctrl.Stop()
+		ctrl.Stop() // Idempotent
+		require.NoError(t, args.Get(0).(context.Context).Err())
+	}).Return("working", nil).Once()
+
+	err := Run(context.Background(), cfg, mockRunner, "p", WithControl(ctrl))
+	require.ErrorIs(t, err, ErrInterrupted)
+	mockRunner.AssertExpectations(t)
+}
+
+func TestRun_Stop_DuringDelay(t *testing.T) {
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:        5,
+			StopPhrase:      "DONE",
+			TimeoutDuration: time.Minute,
+			Delay:           "1h",
+			DelayDuration:   time.Hour,
+		},
+	}
+
+	ctrl := NewControl()
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("working", nil).Once()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		ctrl.Stop()
+	}()
+
+	start := time.Now()
+	err := Run(context.Background(), cfg, mockRunner, "p", WithControl(ctrl))
+	require.ErrorIs(t, err, ErrInterrupted)
+	require.Less(t, time.Since(start), 5*time.Second)
+	mockRunner.AssertExpectations(t)
+}
+
+func TestRun_SkipDelay(t *testing.T) {
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:        5,
+			StopPhrase:      "DONE",
+			TimeoutDuration: time.Minute,
+			Delay:           "1h",
+			DelayDuration:   time.Hour,
+		},
+	}
+
+	ctrl := NewControl()
+	require.False(t, ctrl.SkipDelay()) // Not waiting yet
+
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("working", nil).Once()
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("DONE", nil).Once()
+
+	go func() {
+		for !ctrl.SkipDelay() {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	require.NoError(t, Run(context.Background(), cfg, mockRunner, "p", WithControl(ctrl)))
+	require.Less(t, time.Since(start), 5*time.Second)
+	mockRunner.AssertExpectations(t)
+}
+
+func TestRun_ContextCancelled(t *testing.T) {
+	// Scenario: The caller cancels the context (force quit) mid-step.
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:        5,
+			StopPhrase:      "DONE",
+			TimeoutDuration: time.Minute,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Run(func(args mock.Arguments) {
+		cancel()
+		<-args.Get(0).(context.Context).Done()
+	}).Return("", nil).Once()
+
+	err := Run(ctx, cfg, mockRunner, "p")
+	require.ErrorIs(t, err, ErrInterrupted)
+	mockRunner.AssertExpectations(t)
+}
+
+func TestControl_PauseResume(t *testing.T) {
+	c := NewControl()
+	require.False(t, c.Paused())
+	require.Nil(t, c.Resumed())
+
+	c.Pause()
+	c.Pause() // Idempotent
+	require.True(t, c.Paused())
+	resumed := c.Resumed()
+	require.NotNil(t, resumed)
+
+	c.Resume()
+	require.False(t, c.Paused())
+	_, open := <-resumed
+	require.False(t, open)
+	c.Resume() // No-op when not paused
+}
+
+func TestRun_Pause(t *testing.T) {
+	// Scenario: A pause requested during step 1 holds step 2 back until resumed.
+	// The frozen clock lets the pause outlast the global timeout.
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:            2,
+			StopPhrase:          "DONE",
+			TimeoutDuration:     200 * time.Millisecond,
+			PauseFreezesTimeout: true,
+		},
+	}
+
+	ctrl := NewControl()
+	var pausedAt time.Time
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Run(func(args mock.Arguments) {
+		ctrl.Pause()
+		pausedAt = time.Now()
+		go func() {
+			time.Sleep(400 * time.Millisecond)
+			ctrl.Resume()
+		}()
+	}).Return("working", nil).Once()
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Run(func(args mock.Arguments) {
+		require.GreaterOrEqual(t, time.Since(pausedAt), 400*time.Millisecond)
+	}).Return("DONE", nil).Once()
+
+	err := Run(context.Background(), cfg, mockRunner, "p", WithControl(ctrl))
+	require.NoError(t, err)
+	mockRunner.AssertExpectations(t)
+}
+
+func TestRun_Pause_TimeoutKeepsRunning(t *testing.T) {
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:        2,
+			StopPhrase:      "DONE",
+			TimeoutDuration: 100 * time.Millisecond,
+		},
+	}
+
+	ctrl := NewControl()
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Run(func(args mock.Arguments) {
+		ctrl.Pause()
+	}).Return("working", nil).Once()
+
+	err := Run(context.Background(), cfg, mockRunner, "p", WithControl(ctrl))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "global timeout reached while paused")
+	mockRunner.AssertExpectations(t)
+}
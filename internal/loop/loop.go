@@ -2,155 +2,729 @@ package loop
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"os/exec"
+	"regexp"
 	"strings"
+	"text/template"
 	"time"
 
+	"github.com/eduardolat/clancy/internal/ansi"
 	"github.com/eduardolat/clancy/internal/config"
 	"github.com/eduardolat/clancy/internal/runner"
+	"github.com/eduardolat/clancy/internal/runs"
 )
 
-// ANSI Color Codes
+// verifyTailLines is how many lines of a failed verification are passed to
+// the next step's prompt.
+const verifyTailLines = 50
+
+// maxStepRetries is how many times in a row a retry_same_step rule repeats a
+// step. After that the step counts like any other failed one.
+const maxStepRetries = 3
+
+// StepStatus describes how a single agent invocation ended.
+type StepStatus string
+
 const (
-	colorReset  = "\033[0m"
-	colorCyan   = "\033[36m"
-	colorGreen  = "\033[32m"
-	colorYellow = "\033[33m"
-	colorRed    = "\033[31m"
+	StepCompleted StepStatus = "completed"    // The agent exited on its own
+	StepTimedOut  StepStatus = "timed out"    // The step timeout killed the agent
+	StepIdle      StepStatus = "idle timeout" // The agent was killed for producing no output
 )
 
+// StepResult holds the outcome of a single loop iteration.
+type StepResult struct {
+	Step   int
+	Status StepStatus
+	Output string
+	Err    error
+	// ExitCode is the agent's exit status: 0 on success, -1 when it is
+	// unknown (the agent could not start or was killed by a signal).
+	ExitCode int
+	Started  time.Time
+	Duration time.Duration
+}
+
+// AbortError is returned by Run when the agent printed one of the configured
+// abort phrases, signalling it gave up.
+type AbortError struct {
+	Step   int
+	Phrase string
+}
+
+func (e *AbortError) Error() string {
+	return fmt.Sprintf("agent aborted in step %d: abort phrase %q found", e.Step, e.Phrase)
+}
+
+// ExitCodeError is returned by Run when an on_exit_code rule with the "fail"
+// action matched the agent's exit code.
+type ExitCodeError struct {
+	Step     int
+	ExitCode int
+}
+
+func (e *ExitCodeError) Error() string {
+	return fmt.Sprintf("agent exited with code %d in step %d", e.ExitCode, e.Step)
+}
+
+// MaxStepsError is returned by Run when every step ran without the stop
+// condition being met.
+type MaxStepsError struct {
+	MaxSteps int
+}
+
+func (e *MaxStepsError) Error() string {
+	return fmt.Sprintf("max steps (%d) reached without success", e.MaxSteps)
+}
+
+// ConsecutiveFailuresError is returned by Run when the agent failed to run
+// loop.max_consecutive_failures times in a row.
+type ConsecutiveFailuresError struct {
+	Failures int
+	Err      error // The last failure
+}
+
+func (e *ConsecutiveFailuresError) Error() string {
+	return fmt.Sprintf("agent failed %d times in a row, last error: %v", e.Failures, e.Err)
+}
+
+func (e *ConsecutiveFailuresError) Unwrap() error {
+	return e.Err
+}
+
+// Option configures optional behavior of Run.
+type Option func(*options)
+
+type options struct {
+	control    *Control
+	run        *runs.Run
+	observers  []Observer
+	configFile string
+	verifier   runner.AgentRunner
+}
+
+// WithControl lets the caller stop the loop gracefully through c.
+func WithControl(c *Control) Option {
+	return func(o *options) {
+		o.control = c
+	}
+}
+
+// WithRun persists the progress of the loop to run after every step. When the
+// run already made progress, the loop resumes from its next step with the
+// remaining global timeout.
+func WithRun(run *runs.Run) Option {
+	return func(o *options) {
+		o.run = run
+	}
+}
+
+// WithVerifier runs loop.verify with v instead of the agent runner, e.g. one
+// without the stream stop and idle watchdog of the agent.
+func WithVerifier(v runner.AgentRunner) Option {
+	return func(o *options) {
+		o.verifier = v
+	}
+}
+
 // Run executes the Ralph loop based on the provided configuration.
-func Run(cfg *config.Config, r runner.AgentRunner, prompt string) error {
-	ctx := context.Background()
-	if cfg.Loop.TimeoutDuration > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, cfg.Loop.TimeoutDuration)
-		defer cancel()
+// Cancelling ctx kills the running agent and ends the loop with
+// ErrInterrupted, just like a stop requested through a Control.
+func Run(ctx context.Context, cfg *config.Config, r runner.AgentRunner, prompt string, opts ...Option) (err error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
 	}
+	if o.verifier == nil {
+		o.verifier = r
+	}
+
+	// A resumed run starts where it left off, with what is left of the budget.
+	first := 1
+	timeout := cfg.Loop.TimeoutDuration
+	var spent time.Duration // Elapsed in previous sessions of the run
+	if o.run != nil {
+		first = max(o.run.State.NextStep, 1)
+		spent = time.Duration(o.run.State.Elapsed)
+		if timeout > 0 {
+			timeout -= spent
+		}
+	}
+
+	parent := ctx
+	ctx, clock, cancel := withBudget(ctx, timeout)
+	defer cancel()
+	o.control.attach(clock, spent)
 
-	cmd := runner.PrepareCommand(cfg.Agent.Command, prompt)
+	// Bookkeeping for the summary reported when the run ends.
+	stepsRun := 0
+	var last StepResult
 
-	for i := 1; i <= cfg.Loop.MaxSteps; i++ {
-		// 1. HEADER (Cyan Box)
-		if i > 1 {
-			_, _ = fmt.Fprint(os.Stdout, "\n\n") // Visual separation from previous step
+	// checkpoint saves the run state, so it can be resumed from step next.
+	checkpoint := func(next int, status string) {
+		if o.run == nil {
+			return
+		}
+		o.run.State.NextStep = next
+		o.run.State.Status = status
+		o.run.State.Elapsed = runs.Duration(spent + clock.elapsed())
+		if err := o.run.Save(); err != nil {
+			o.warn(err)
 		}
+	}
+	next := first
 
-		// Update Window Title (Passive Monitoring)
-		_, _ = fmt.Fprintf(os.Stdout, "\033]0;🍩 Clancy: Step %d/%d\007", i, cfg.Loop.MaxSteps)
+	runID := ""
+	if o.run != nil {
+		runID = o.run.State.ID
+	}
+	o.notify(func(obs Observer) {
+		obs.OnRunStart(RunInfo{RunID: runID, FirstStep: first, MaxSteps: cfg.Loop.MaxSteps, Timeout: max(timeout, 0)})
+	})
+	defer func() {
+		clock.freeze() // The budget stops counting down with the run
+		checkpoint(next, runStatus(err))
+		summary := RunSummary{Reason: runReason(err), Err: err, Steps: stepsRun, Elapsed: clock.elapsed(), Last: last}
+		o.notify(func(obs Observer) { obs.OnRunEnd(summary) })
+	}()
+	if cfg.Loop.TimeoutDuration > 0 && timeout <= 0 {
+		return fmt.Errorf("%w in a previous session of the run", ErrTimeout)
+	}
 
-		printHeaderBox(i, cfg.Loop.MaxSteps)
+	interruptRequested := func() bool {
+		return parent.Err() != nil || o.control.stopRequested()
+	}
+	// end reports err, unless the user asked to stop, which takes precedence.
+	end := func(err error) error {
+		if interruptRequested() {
+			return ErrInterrupted
+		}
+		return err
+	}
+
+	// feedback is appended to the prompt of the next step only, e.g. the
+	// output of a failed verification.
+	feedback := ""
+
+	// With input.progress the agent keeps notes in a file Clancy owns, and
+	// the run ends when it stops updating them.
+	var progress *progressTracker
+	if cfg.Input.Progress.Enabled {
+		progress = &progressTracker{path: progressPath(cfg.Input.Progress, o.run)}
+		if err := createProgress(progress.path); err != nil {
+			return err
+		}
+		if progress.last, err = progress.read(); err != nil {
+			return err
+		}
+	}
+	expand := func(s string) string {
+		if progress == nil {
+			return s
+		}
+		return strings.ReplaceAll(s, ProgressPlaceholder, progress.path)
+	}
+
+	// With input.template the prompt is rendered on every step, and can
+	// refer to the previous one, like input.carry_over.
+	parse := func(prompt string) (*template.Template, error) {
+		if !cfg.Input.Template {
+			return nil, nil
+		}
+		tmpl, err := ParsePrompt(expand(prompt))
+		if err != nil {
+			return nil, fmt.Errorf("invalid prompt template: %w", err)
+		}
+		return tmpl, nil
+	}
+	tmpl, err := parse(prompt)
+	if err != nil {
+		return err
+	}
+
+	// With input.reload the prompt and the agent settings are read again
+	// before every step.
+	src := source{prompt: prompt, command: cfg.Agent.Command, env: cfg.Agent.Env}
+	prevExitCode, prevOutput := lastStep(o.run)
+
+	// failures counts consecutive invocations that could not run properly.
+	failures := 0
+	retries := 0 // Repetitions of the current step by retry_same_step
+	backoffs := newBackoffState()
+
+	for i := first; i <= cfg.Loop.MaxSteps; i++ {
+		if interruptRequested() {
+			return ErrInterrupted
+		}
+
+		// 0. PAUSE (Yellow Box), requested between steps
+		if err := waitWhilePaused(ctx, &o, clock, cfg, i); err != nil {
+			return end(err)
+		}
+
+		// Edits made while the previous step ran apply from this one.
+		var reloaded Reload
+		if cfg.Input.Reload && stepsRun > 0 {
+			fresh, err := reload(cfg, o.configFile)
+			var t *template.Template
+			if err == nil {
+				t, err = parse(fresh.prompt)
+			}
+			if err != nil {
+				o.warn(err) // Keep going with the current settings
+			} else if reloaded = src.changes(fresh); reloaded.changed() {
+				src, tmpl = fresh, t
+			}
+		}
+
+		text := expand(src.prompt)
+		if tmpl != nil {
+			rendered, err := renderPrompt(tmpl, PromptData{
+				Step:               i,
+				MaxSteps:           cfg.Loop.MaxSteps,
+				Elapsed:            (spent + clock.elapsed()).Round(time.Second),
+				Remaining:          clock.left().Round(time.Second),
+				PreviousOutputTail: outputTail(prevOutput),
+				PreviousExitCode:   prevExitCode,
+				RunID:              runID,
+				Vars:               cfg.Input.Vars,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to render the prompt of step %d: %w", i, err)
+			}
+			text = rendered
+		}
+		if cfg.Input.CarryOver.Enabled {
+			text += carryOver(cfg.Input.CarryOver, prevOutput)
+		}
+		cmd := runner.PrepareCommand(expand(src.command), text+feedback)
+		feedback = ""
 
 		// Check Context before execution
 		select {
 		case <-ctx.Done():
-			return fmt.Errorf("global timeout reached")
+			return end(ErrTimeout)
 		default:
 		}
 
-		// 2. EXECUTION (With breathing room)
-		_, _ = fmt.Fprintln(os.Stdout) // Blank line BEFORE agent output
-		output, err := r.Run(cmd, cfg.Agent.Env)
-		_, _ = fmt.Fprintln(os.Stdout) // Blank line AFTER agent output
+		// 1. HEADER
+		if reloaded.changed() {
+			o.notify(func(obs Observer) { obs.OnReload(i, reloaded) })
+		}
+		o.notify(func(obs Observer) { obs.OnStepStart(i) })
 
-		if err != nil {
-			// CRITICAL ERROR (Red Box)
-			printErrorBox(err)
+		// Record the session, so it can be watched later with "clancy replay".
+		var rec *runs.Recording
+		if o.run != nil && cfg.Agent.Record {
+			cols, rows := runner.TerminalSize()
+			var err error
+			rec, err = o.run.Record(i, o.run.Attempts(i)+1, cols, rows)
+			if err != nil {
+				o.warn(err)
+			}
+		}
+
+		// 2. EXECUTION
+		out := []io.Writer{stepOutput{o: &o, step: i}}
+		if rec != nil {
+			out = append(out, rec)
+		}
+		res := runStep(ctx, cfg, r, cmd, src.env, i, io.MultiWriter(out...))
+		if rec != nil {
+			_ = rec.Close()
+		}
+
+		stepsRun++
+		last = res
+		prevExitCode, prevOutput = res.ExitCode, res.Output
+		next = i + 1
+		stopMatched := CheckStop(res.Output, &cfg.Loop)
+		if o.run != nil {
+			o.run.State.Steps = append(o.run.State.Steps, stepRecord(res))
+			meta := stepMeta(res, o.run.Attempts(i), stopMatched)
+			if err := o.run.WriteStep(cmd, res.Output, meta); err != nil {
+				o.warn(err)
+			}
+		}
+		notes := ""
+		if progress != nil {
+			var err error
+			if notes, err = progress.read(); err != nil {
+				o.warn(err)
+			} else if o.run != nil {
+				if err := o.run.WriteProgress(i, o.run.Attempts(i), []byte(notes)); err != nil {
+					o.warn(err)
+				}
+			}
+		}
+		checkpoint(next, runs.StatusRunning)
+		o.notify(func(obs Observer) { obs.OnStepEnd(res, stopMatched) })
+
+		// The step was allowed to finish, but the user wants to stop.
+		if interruptRequested() {
+			return ErrInterrupted
+		}
+
+		// The runner kills the agent when the context expires, so any
+		// output collected is partial and must not be checked.
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w in the middle of step %d", ErrTimeout, i)
+		}
+
+		// Abort phrases win over everything else, the agent told us it is stuck.
+		if phrase, ok := CheckAbort(res.Output, &cfg.Loop); ok {
+			o.notify(func(obs Observer) { obs.OnAbort(i, phrase) })
+			return &AbortError{Step: i, Phrase: phrase}
+		}
+
+		// Rate limits and the like: cool down and repeat the step for free.
+		// The run is saved first, so resuming after an interrupted or
+		// crashed cooldown repeats the step too.
+		if c, ok := matchBackoff(cfg, backoffs, res); ok {
+			next = i
+			checkpoint(next, runs.StatusRunning)
+			if err := backoff(ctx, &o, i, c); err != nil {
+				return end(err)
+			}
+			i--
+			continue
 		}
 
-		// 3. CHECK CONDITION
-		if CheckStopCondition(output, cfg.Loop.StopPhrase, cfg.Loop.StopMode) {
-			// SUCCESS (Green Box)
-			printSuccessBox(i)
-			// Update Window Title to Done
-			_, _ = fmt.Fprint(os.Stdout, "\033]0;✅ Clancy: Done\007")
-			return nil
+		action := exitCodeAction(cfg.Loop.OnExitCode, res)
+		if action == config.ExitActionRetry && retries >= maxStepRetries {
+			action = ""
+		}
+
+		// Circuit breaker: stop burning steps when the agent cannot even run.
+		// An agent printing the stop phrase did run, whatever its exit code.
+		if res.Status == StepCompleted && action != config.ExitActionSucceed {
+			switch {
+			case res.Err == nil, stopMatched:
+				failures = 0
+			case action != config.ExitActionContinue:
+				failures++
+			}
+		}
+		if limit := cfg.Loop.MaxConsecutiveFailures; limit > 0 && failures >= limit {
+			o.notify(func(obs Observer) {
+				obs.OnStepError(i, res.Err)
+				obs.OnCircuitBreaker(failures)
+			})
+			return &ConsecutiveFailuresError{Failures: failures, Err: res.Err}
+		}
+
+		if action != "" && action != config.ExitActionContinue {
+			o.notify(func(obs Observer) { obs.OnExitCode(i, res.ExitCode, action) })
+		}
+		switch action {
+		case config.ExitActionFail:
+			return &ExitCodeError{Step: i, ExitCode: res.ExitCode}
+
+		case config.ExitActionRetry:
+			retries++
+			next = i
+			checkpoint(next, runs.StatusRunning)
+			if err := sleep(ctx, &o, cfg, i); err != nil {
+				return end(err)
+			}
+			i-- // The step does not count
+			continue
+		}
+		retries = 0
+
+		switch {
+		case res.Status == StepTimedOut:
+			o.notify(func(obs Observer) { obs.OnStepTimeout(i, cfg.Loop.StepTimeoutDuration) })
+			if cfg.Loop.OnStepTimeout == config.StepTimeoutAbort {
+				return fmt.Errorf("step %d timed out after %s", i, cfg.Loop.StepTimeout)
+			}
+
+		case res.Status == StepIdle:
+			o.notify(func(obs Observer) { obs.OnIdleTimeout(i, cfg.Loop.IdleTimeoutDuration) })
+
+		case res.Err != nil && action != config.ExitActionContinue && action != config.ExitActionSucceed:
+			o.notify(func(obs Observer) { obs.OnStepError(i, res.Err) })
+			fallthrough
+
+		default:
+			// 3. CHECK CONDITION
+			if stopMatched || action == config.ExitActionSucceed {
+				// The agent says it is done, make sure it really is.
+				if cfg.Loop.Verify != "" {
+					o.notify(func(obs Observer) { obs.OnVerify(i, cfg.Loop.Verify) })
+					verifyOutput, err := o.verifier.Run(ctx, cfg.Loop.Verify, src.env, nil)
+
+					if ctx.Err() != nil {
+						return end(fmt.Errorf("%w while verifying step %d", ErrTimeout, i))
+					}
+					o.notify(func(obs Observer) { obs.OnVerifyEnd(i, err) })
+					if err != nil {
+						feedback = verifyFeedback(cfg.Loop.Verify, verifyOutput, err)
+						break
+					}
+				}
+
+				o.notify(func(obs Observer) { obs.OnStopFound(i) })
+				return nil
+			}
 		}
 
 		// 4. RETRY & DELAY
 		if i < cfg.Loop.MaxSteps {
-			// RETRY (Yellow Box)
-			printRetryBox(i)
-
-			if cfg.Loop.DelayDuration > 0 {
-				// COOLDOWN (Yellow Box)
-				printCooldownBox(cfg.Loop.Delay)
-
-				// Sleep with context check
-				select {
-				case <-ctx.Done():
-					return fmt.Errorf("global timeout reached during delay")
-				case <-time.After(cfg.Loop.DelayDuration):
-					// Continue to next iteration
+			// The agent keeps going without writing anything down.
+			if progress != nil {
+				steps := progress.update(notes)
+				if limit := cfg.Input.Progress.StallSteps; limit > 0 && steps >= limit {
+					o.notify(func(obs Observer) { obs.OnNoProgress(i, steps) })
+					return &NoProgressError{Steps: steps, Path: progress.path}
 				}
 			}
+
+			// The verification failure already explained why
+			if feedback == "" {
+				o.notify(func(obs Observer) { obs.OnRetry(i) })
+			}
+
+			if err := sleep(ctx, &o, cfg, i); err != nil {
+				return end(err)
+			}
 		}
 	}
 
-	return fmt.Errorf("max steps (%d) reached without success", cfg.Loop.MaxSteps)
+	return &MaxStepsError{MaxSteps: cfg.Loop.MaxSteps}
 }
 
-// CheckStopCondition evaluates if the output meets the stop criteria.
-func CheckStopCondition(output, phrase, mode string) bool {
-	cleanOutput := strings.TrimSpace(output)
+// sleep waits for the configured delay after step, if any. A stop requested
+// through the control cuts the wait short.
+func sleep(ctx context.Context, o *options, cfg *config.Config, step int) error {
+	if cfg.Loop.DelayDuration <= 0 {
+		return nil
+	}
 
-	switch mode {
-	case "exact":
-		return cleanOutput == phrase
-	case "contains":
-		return strings.Contains(cleanOutput, phrase)
+	o.notify(func(obs Observer) { obs.OnCooldown(step, cfg.Loop.DelayDuration) })
+
+	// Sleep with context check
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("%w during delay", ErrTimeout)
+	case <-o.control.Stopping():
+		return ErrInterrupted
+	case <-o.control.skipped():
+		return nil
+	case <-time.After(cfg.Loop.DelayDuration):
+		return nil
+	}
+}
+
+// waitWhilePaused blocks while the loop is paused, optionally freezing the
+// global timeout clock meanwhile.
+func waitWhilePaused(ctx context.Context, o *options, clock *budget, cfg *config.Config, step int) error {
+	resumed := o.control.Resumed()
+	if resumed == nil {
+		return nil
+	}
+
+	o.notify(func(obs Observer) { obs.OnPause(step, cfg.Loop.PauseFreezesTimeout) })
+
+	if cfg.Loop.PauseFreezesTimeout {
+		clock.freeze()
+		defer clock.thaw()
+	}
+
+	select {
+	case <-resumed:
+		o.notify(func(obs Observer) { obs.OnResume(step) })
+		return nil
+	case <-o.control.Stopping():
+		return ErrInterrupted
+	case <-ctx.Done():
+		return fmt.Errorf("%w while paused", ErrTimeout)
+	}
+}
+
+// runStatus maps the error returned by Run to the status of a persisted run.
+func runStatus(err error) string {
+	switch {
+	case err == nil:
+		return runs.StatusSucceeded
+	case errors.Is(err, ErrInterrupted):
+		return runs.StatusInterrupted
 	default:
-		// Default to "suffix"
-		return strings.HasSuffix(cleanOutput, phrase)
+		return runs.StatusFailed
+	}
+}
+
+// stepRecord converts a step result into its persisted form.
+func stepRecord(res StepResult) runs.StepRecord {
+	rec := runs.StepRecord{
+		Step:      res.Step,
+		Status:    string(res.Status),
+		ExitCode:  res.ExitCode,
+		StartedAt: res.Started,
+		Duration:  runs.Duration(res.Duration),
+	}
+	if res.Err != nil {
+		rec.Error = res.Err.Error()
+	}
+	return rec
+}
+
+// stepMeta describes a step for its artifacts.
+func stepMeta(res StepResult, attempt int, stopMatched bool) runs.StepMeta {
+	rec := stepRecord(res)
+	return runs.StepMeta{
+		Step:        rec.Step,
+		Attempt:     attempt,
+		Status:      rec.Status,
+		ExitCode:    rec.ExitCode,
+		Error:       rec.Error,
+		StartedAt:   res.Started,
+		EndedAt:     res.Started.Add(res.Duration),
+		Duration:    rec.Duration,
+		StopMatched: stopMatched,
+	}
+}
+
+// exitCodeAction returns the action of the first on_exit_code rule matching
+// the step's exit code, or "" when none applies. Steps stopped by Clancy
+// itself (timeouts) are never matched.
+func exitCodeAction(rules []config.ExitCodeRule, res StepResult) string {
+	if res.Status != StepCompleted || res.ExitCode < 0 {
+		return ""
+	}
+	for _, rule := range rules {
+		if rule.Matches(res.ExitCode) {
+			return rule.Action
+		}
+	}
+	return ""
+}
+
+// runStep invokes the agent once with env, bounding it by the step timeout if
+// set. The agent output is also streamed to out, if not nil.
+func runStep(ctx context.Context, cfg *config.Config, r runner.AgentRunner, cmd string, env map[string]string, step int, out io.Writer) StepResult {
+	stepCtx := ctx
+	if cfg.Loop.StepTimeoutDuration > 0 {
+		var cancel context.CancelFunc
+		stepCtx, cancel = context.WithTimeout(ctx, cfg.Loop.StepTimeoutDuration)
+		defer cancel()
+	}
+
+	started := time.Now()
+	output, err := r.Run(stepCtx, cmd, env, out)
+
+	res := StepResult{Step: step, Status: StepCompleted, Output: output, Err: err}
+	res.Started, res.Duration = started, time.Since(started)
+	res.ExitCode = exitCode(err)
+	switch {
+	case ctx.Err() != nil:
+		// Global timeout, handled by the caller.
+	case stepCtx.Err() != nil:
+		res.Status = StepTimedOut
+	case errors.Is(err, runner.ErrIdleTimeout):
+		res.Status = StepIdle
 	}
+	return res
+}
+
+// verifyFeedback builds the prompt section that tells the next step why the
+// verification command rejected the previous one.
+func verifyFeedback(command, output string, err error) string {
+	tail := ansi.Tail(ansi.Strip(output), verifyTailLines)
+	return fmt.Sprintf("\n\n## Verification failed\n\n"+
+		"The previous step reported success, but the verification command `%s` failed (%v). "+
+		"Fix the problems before finishing again. Last lines of its output:\n\n```\n%s\n```\n",
+		command, err, tail)
 }
 
-// --- Visual Helpers (Box System) ---
+// StreamStop returns the check and quiet period a runner should use to detect
+// the stop phrase while the agent is still running. In "contains" mode the
+// agent is stopped as soon as the phrase appears; the other modes need the
+// phrase to stay at the end of the output, so they wait for the stream to go
+// quiet first.
+func StreamStop(cfg *config.Config) (check func(output string) bool, quiet time.Duration) {
+	check = func(output string) bool {
+		return CheckStop(output, &cfg.Loop)
+	}
+	if cfg.Loop.StopMode == "contains" {
+		return check, 0
+	}
+	return check, cfg.Loop.StreamStopQuietDuration
+}
 
-func printHeaderBox(step, total int) {
-	c := colorCyan
-	r := colorReset
-	// Heavy box style for high visibility
-	_, _ = fmt.Fprintf(os.Stdout, "%s━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━%s\n", c, r)
-	_, _ = fmt.Fprintf(os.Stdout, "%s  🍩 CLANCY: STEP %02d/%02d%s\n", c, step, total, r)
-	_, _ = fmt.Fprintf(os.Stdout, "%s━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━%s\n", c, r)
+// exitCode extracts the process exit status from the error returned by a
+// runner.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
 }
 
-func printSuccessBox(step int) {
-	g := colorGreen
-	r := colorReset
-	_, _ = fmt.Fprintf(os.Stdout, "%s━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━%s\n", g, r)
-	_, _ = fmt.Fprintf(os.Stdout, "%s  ✅ CLANCY: Stop phrase found in step %02d%s\n", g, step, r)
-	_, _ = fmt.Fprintf(os.Stdout, "%s━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━%s\n", g, r)
+// CheckStop evaluates every stop phrase configured in l against the output,
+// honoring the "regex" mode and the "any"/"all" match semantics.
+func CheckStop(output string, l *config.LoopConfig) bool {
+	_, ok := matchPhrases(output, l.StopPhraseList(), l.StopRegexps, l.StopMode, l.StopMatch)
+	return ok
 }
 
-func printRetryBox(step int) {
-	y := colorYellow
-	r := colorReset
-	_, _ = fmt.Fprintf(os.Stdout, "%s━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━%s\n", y, r)
-	_, _ = fmt.Fprintf(os.Stdout, "%s  🔄 CLANCY: Stop phrase NOT found in step %02d. Continuing...%s\n", y, step, r)
-	_, _ = fmt.Fprintf(os.Stdout, "%s━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━%s\n", y, r)
+// CheckAbort reports whether the output contains any of the abort phrases
+// configured in l, and which one matched.
+func CheckAbort(output string, l *config.LoopConfig) (string, bool) {
+	return matchPhrases(output, l.AbortPhrases, l.AbortRegexps, l.AbortMode, config.MatchAny)
 }
 
-func printErrorBox(err error) {
-	red := colorRed
-	r := colorReset
-	// Format error string to fit roughly in the box
-	// Truncate to 55 chars to allow for "..."
-	errStr := fmt.Sprintf("%.55s...", err.Error())
+// matchPhrases checks phrases against output using mode. In "regex" mode the
+// precompiled regexps are used instead of the raw phrases, against the
+// output without ANSI escape codes and with LF line endings, so anchors work.
+// With match "all" every phrase must match, otherwise one is enough. It
+// returns the phrase that decided the result.
+func matchPhrases(output string, phrases []string, regexps []*regexp.Regexp, mode, match string) (string, bool) {
+	clean := output
+	if mode == "regex" {
+		clean = strings.TrimSpace(ansi.Strip(output))
+	}
+	matchOne := func(i int) bool {
+		if mode == "regex" {
+			return i < len(regexps) && regexps[i].MatchString(clean)
+		}
+		return CheckStopCondition(output, phrases[i], mode)
+	}
+
+	if match == config.MatchAll {
+		for i := range phrases {
+			if !matchOne(i) {
+				return "", false
+			}
+		}
+		return strings.Join(phrases, ", "), len(phrases) > 0
+	}
 
-	_, _ = fmt.Fprintf(os.Stderr, "%s━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━%s\n", red, r)
-	_, _ = fmt.Fprintf(os.Stderr, "%s  💥 CLANCY: Agent execution failed!%s\n", red, r)
-	_, _ = fmt.Fprintf(os.Stderr, "%s  %v%s\n", red, errStr, r)
-	_, _ = fmt.Fprintf(os.Stderr, "%s━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━%s\n", red, r)
+	for i, phrase := range phrases {
+		if matchOne(i) {
+			return phrase, true
+		}
+	}
+	return "", false
 }
 
-func printCooldownBox(delay string) {
-	y := colorYellow
-	r := colorReset
-	// Cooldown also uses the box style now
-	_, _ = fmt.Fprintf(os.Stdout, "\n%s━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━%s\n", y, r)
-	_, _ = fmt.Fprintf(os.Stdout, "%s  ⏳ CLANCY: Waiting %s before next step...%s\n", y, delay, r)
-	_, _ = fmt.Fprintf(os.Stdout, "%s━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━%s\n", y, r)
+// CheckStopCondition evaluates if the output meets the stop criteria.
+func CheckStopCondition(output, phrase, mode string) bool {
+	cleanOutput := strings.TrimSpace(output)
+
+	switch mode {
+	case "exact":
+		return cleanOutput == phrase
+	case "contains":
+		return strings.Contains(cleanOutput, phrase)
+	default:
+		// Default to "suffix"
+		return strings.HasSuffix(cleanOutput, phrase)
+	}
 }
@@ -1,10 +1,20 @@
 package loop
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/eduardolat/clancy/internal/config"
+	"github.com/eduardolat/clancy/internal/runner"
+	"github.com/eduardolat/clancy/internal/runs"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
@@ -14,8 +24,11 @@ type MockRunner struct {
 	mock.Mock
 }
 
-func (m *MockRunner) Run(command string, env map[string]string) (string, error) {
-	args := m.Called(command, env)
+func (m *MockRunner) Run(ctx context.Context, command string, env map[string]string, out io.Writer) (string, error) {
+	args := m.Called(ctx, command, env)
+	if out != nil {
+		_, _ = io.WriteString(out, args.String(0))
+	}
 	return args.String(0), args.Error(1)
 }
 
@@ -36,9 +49,9 @@ func TestRun_Success(t *testing.T) {
 	mockRunner := new(MockRunner)
 	// Expectation: Run called once.
 	// Note: Command will have prompt injected. "echo 'do work'"
-	mockRunner.On("Run", "echo 'do work'", cfg.Agent.Env).Return("Work complete. RALPH_DONE", nil).Times(1)
+	mockRunner.On("Run", mock.Anything, "echo 'do work'", cfg.Agent.Env).Return("Work complete. RALPH_DONE", nil).Times(1)
 
-	err := Run(cfg, mockRunner, prompt)
+	err := Run(context.Background(), cfg, mockRunner, prompt)
 	require.NoError(t, err)
 	mockRunner.AssertExpectations(t)
 }
@@ -57,11 +70,11 @@ func TestRun_MultiStep_Success(t *testing.T) {
 
 	mockRunner := new(MockRunner)
 	// Call 1
-	mockRunner.On("Run", "cmd", cfg.Agent.Env).Return("working...", nil).Once()
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("working...", nil).Once()
 	// Call 2
-	mockRunner.On("Run", "cmd", cfg.Agent.Env).Return("DONE", nil).Once()
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("DONE", nil).Once()
 
-	err := Run(cfg, mockRunner, "p")
+	err := Run(context.Background(), cfg, mockRunner, "p")
 	require.NoError(t, err)
 	mockRunner.AssertExpectations(t)
 }
@@ -79,9 +92,9 @@ func TestRun_MaxSteps_Reached(t *testing.T) {
 	}
 
 	mockRunner := new(MockRunner)
-	mockRunner.On("Run", "cmd", cfg.Agent.Env).Return("still working", nil).Times(3)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("still working", nil).Times(3)
 
-	err := Run(cfg, mockRunner, "p")
+	err := Run(context.Background(), cfg, mockRunner, "p")
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "max steps (3) reached")
 	mockRunner.AssertExpectations(t)
@@ -105,29 +118,41 @@ func TestRun_Timeout(t *testing.T) {
 	// However, if we set timeout to 1ms, it likely expires before the first run or during it.
 	// Let's make the Mock sleep slightly to force timeout.
 
-	mockRunner.On("Run", "cmd", cfg.Agent.Env).Run(func(args mock.Arguments) {
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Run(func(args mock.Arguments) {
 		time.Sleep(10 * time.Millisecond)
 	}).Return("working", nil)
 
-	err := Run(cfg, mockRunner, "p")
+	err := Run(context.Background(), cfg, mockRunner, "p")
 	require.Error(t, err)
-	// It could be "global timeout reached" or the loop just finished 1 step and then timed out on next check.
-	// If the sleep happens inside Run, Run returns, then loop checks ctx.Done().
-
-	// Wait, if Run takes long, the ctx might be done when Run returns.
-	// Our loop check is at the top of the loop.
-	// So:
-	// 1. Loop start.
-	// 2. Check ctx. Not done.
-	// 3. Run() (Sleeps 10ms). Timeout (1ms) expires during sleep.
-	// 4. Run returns.
-	// 5. Check Stop (False).
-	// 6. Loop increments.
-	// 7. Check ctx. Done! -> Return Error.
-
+	// The timeout (1ms) expires while the mock sleeps inside Run, so the
+	// loop detects it as soon as Run returns, in the middle of step 1.
 	require.Contains(t, err.Error(), "global timeout reached")
 }
 
+func TestRun_Timeout_CancelsStep(t *testing.T) {
+	// Scenario: The agent hangs until its context is cancelled.
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:        10,
+			StopPhrase:      "DONE",
+			TimeoutDuration: 50 * time.Millisecond,
+		},
+	}
+
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Run(func(args mock.Arguments) {
+		<-args.Get(0).(context.Context).Done()
+	}).Return("partial output DONE", nil).Once()
+
+	start := time.Now()
+	err := Run(context.Background(), cfg, mockRunner, "p")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "global timeout reached in the middle of step 1")
+	require.Less(t, time.Since(start), 5*time.Second)
+	mockRunner.AssertExpectations(t)
+}
+
 func TestCheckStopCondition(t *testing.T) {
 	require.True(t, CheckStopCondition(" foo DONE bar ", "DONE", "contains"))
 	require.False(t, CheckStopCondition(" foo done bar ", "DONE", "contains")) // Case sensitive usually
@@ -160,12 +185,12 @@ func TestRun_WithDelay(t *testing.T) {
 
 	mockRunner := new(MockRunner)
 	// Call 1
-	mockRunner.On("Run", "cmd", cfg.Agent.Env).Return("working...", nil).Once()
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("working...", nil).Once()
 	// Call 2
-	mockRunner.On("Run", "cmd", cfg.Agent.Env).Return("DONE", nil).Once()
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("DONE", nil).Once()
 
 	start := time.Now()
-	err := Run(cfg, mockRunner, "p")
+	err := Run(context.Background(), cfg, mockRunner, "p")
 	duration := time.Since(start)
 
 	require.NoError(t, err)
@@ -174,3 +199,691 @@ func TestRun_WithDelay(t *testing.T) {
 	// Should have waited at least 100ms
 	require.GreaterOrEqual(t, duration, 100*time.Millisecond)
 }
+
+func TestRun_StepTimeout_Continue(t *testing.T) {
+	// Scenario: First step hangs and is cut by the step timeout, second succeeds.
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:            3,
+			StopPhrase:          "DONE",
+			StopMode:            "exact",
+			TimeoutDuration:     time.Minute,
+			StepTimeout:         "50ms",
+			StepTimeoutDuration: 50 * time.Millisecond,
+			OnStepTimeout:       config.StepTimeoutContinue,
+		},
+	}
+
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Run(func(args mock.Arguments) {
+		<-args.Get(0).(context.Context).Done()
+	}).Return("DONE", nil).Once()
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("DONE", nil).Once()
+
+	err := Run(context.Background(), cfg, mockRunner, "p")
+	require.NoError(t, err)
+	mockRunner.AssertExpectations(t)
+}
+
+func TestRun_StepTimeout_Abort(t *testing.T) {
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:            3,
+			StopPhrase:          "DONE",
+			TimeoutDuration:     time.Minute,
+			StepTimeout:         "50ms",
+			StepTimeoutDuration: 50 * time.Millisecond,
+			OnStepTimeout:       config.StepTimeoutAbort,
+		},
+	}
+
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Run(func(args mock.Arguments) {
+		<-args.Get(0).(context.Context).Done()
+	}).Return("", nil).Once()
+
+	err := Run(context.Background(), cfg, mockRunner, "p")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "step 1 timed out after 50ms")
+	mockRunner.AssertExpectations(t)
+}
+
+func TestRun_IdleTimeout(t *testing.T) {
+	// Scenario: First step is stopped by the idle watchdog, second succeeds.
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:        3,
+			StopPhrase:      "DONE",
+			StopMode:        "exact",
+			TimeoutDuration: time.Minute,
+			IdleTimeout:     "5m",
+		},
+	}
+
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("DONE", fmt.Errorf("stalled: %w", runner.ErrIdleTimeout)).Once()
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("DONE", nil).Once()
+
+	err := Run(context.Background(), cfg, mockRunner, "p")
+	require.NoError(t, err)
+	mockRunner.AssertExpectations(t)
+}
+
+func TestStreamStop(t *testing.T) {
+	cfg := &config.Config{
+		Loop: config.LoopConfig{
+			StopPhrase:              "DONE",
+			StopMode:                "suffix",
+			StreamStopQuietDuration: 3 * time.Second,
+		},
+	}
+
+	check, quiet := StreamStop(cfg)
+	require.Equal(t, 3*time.Second, quiet)
+	require.True(t, check("work... DONE\n"))
+	require.False(t, check("DONE, now cleaning up"))
+
+	cfg.Loop.StopMode = "contains"
+	check, quiet = StreamStop(cfg)
+	require.Zero(t, quiet)
+	require.True(t, check("DONE, now cleaning up"))
+}
+
+func TestCheckStop(t *testing.T) {
+	l := &config.LoopConfig{
+		StopPhrases: []string{"DONE", "FINISHED"},
+		StopMode:    "suffix",
+		StopMatch:   config.MatchAny,
+	}
+	require.True(t, CheckStop("work... FINISHED", l))
+	require.True(t, CheckStop("work... DONE\n", l))
+	require.False(t, CheckStop("DONE and FINISHED and more", l))
+
+	l.StopMode = "contains"
+	l.StopMatch = config.MatchAll
+	require.True(t, CheckStop("DONE and FINISHED and more", l))
+	require.False(t, CheckStop("only DONE", l))
+
+	l = &config.LoopConfig{
+		StopPhrase:  `DONE \(\d+ tests\)$`,
+		StopMode:    "regex",
+		StopMatch:   config.MatchAny,
+		StopRegexps: []*regexp.Regexp{regexp.MustCompile(`DONE \(\d+ tests\)$`)},
+	}
+	require.True(t, CheckStop("all good: DONE (42 tests)  \n", l))
+	require.False(t, CheckStop("DONE (some tests)", l))
+
+	// Escape codes and CRLF line endings from the PTY do not break anchors.
+	l.StopRegexps = []*regexp.Regexp{regexp.MustCompile(`(?m)^DONE$`)}
+	require.True(t, CheckStop("work\r\n\x1b[32mDONE\x1b[0m\r\nbye\r\n", l))
+}
+
+func TestRun_AbortPhrase(t *testing.T) {
+	// Scenario: Agent reports it is blocked in the second step.
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:        5,
+			StopPhrase:      "DONE",
+			StopMode:        "suffix",
+			AbortPhrases:    []string{"<promise>BLOCKED</promise>", "I need human input"},
+			AbortMode:       "contains",
+			TimeoutDuration: time.Minute,
+		},
+	}
+
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("working...", nil).Once()
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("Sorry, I need human input to continue.", nil).Once()
+
+	err := Run(context.Background(), cfg, mockRunner, "p")
+	var abortErr *AbortError
+	require.ErrorAs(t, err, &abortErr)
+	require.Equal(t, 2, abortErr.Step)
+	require.Equal(t, "I need human input", abortErr.Phrase)
+	mockRunner.AssertExpectations(t)
+}
+
+func TestCheckAbort(t *testing.T) {
+	l := &config.LoopConfig{AbortMode: "contains"}
+	_, ok := CheckAbort("BLOCKED", l)
+	require.False(t, ok) // No abort phrases configured
+
+	l.AbortPhrases = []string{"BLOCKED"}
+	phrase, ok := CheckAbort("I am BLOCKED here", l)
+	require.True(t, ok)
+	require.Equal(t, "BLOCKED", phrase)
+
+	l = &config.LoopConfig{
+		AbortPhrases: []string{`(?i)rate.?limit`},
+		AbortMode:    "regex",
+		AbortRegexps: []*regexp.Regexp{regexp.MustCompile(`(?i)rate.?limit`)},
+	}
+	_, ok = CheckAbort("Rate limit exceeded", l)
+	require.True(t, ok)
+}
+
+func TestRun_Verify(t *testing.T) {
+	// Scenario: The agent claims success twice. The first verification fails
+	// and its output must reach the next prompt, the second one passes.
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "agent '${PROMPT}'"},
+		Loop: config.LoopConfig{
+			MaxSteps:        3,
+			StopPhrase:      "DONE",
+			StopMode:        "suffix",
+			Verify:          "go test ./...",
+			TimeoutDuration: time.Minute,
+		},
+	}
+
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "agent 'fix it'", cfg.Agent.Env).Return("DONE", nil).Once()
+	mockRunner.On("Run", mock.Anything, "go test ./...", cfg.Agent.Env).Return("\x1b[31mFAIL: TestFoo\x1b[0m\r\n", fmt.Errorf("exit status 1")).Once()
+	mockRunner.On("Run", mock.Anything, mock.MatchedBy(func(cmd string) bool {
+		return strings.Contains(cmd, "## Verification failed") && strings.Contains(cmd, "FAIL: TestFoo")
+	}), cfg.Agent.Env).Return("DONE", nil).Once()
+	mockRunner.On("Run", mock.Anything, "go test ./...", cfg.Agent.Env).Return("ok", nil).Once()
+
+	err := Run(context.Background(), cfg, mockRunner, "fix it")
+	require.NoError(t, err)
+	mockRunner.AssertExpectations(t)
+}
+
+func TestRun_PromptTemplate(t *testing.T) {
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "agent '${PROMPT}'"},
+		Loop: config.LoopConfig{
+			MaxSteps:        3,
+			StopPhrase:      "DONE",
+			StopMode:        "suffix",
+			TimeoutDuration: time.Hour,
+		},
+		Input: config.InputConfig{
+			Template: true,
+			Vars:     map[string]string{"goal": "tests"},
+		},
+	}
+	prompt := "step {{.Step}}/{{.MaxSteps}} {{.Vars.goal}} prev={{.PreviousExitCode}} tail={{.PreviousOutputTail}} left={{.Remaining}}"
+
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "agent 'step 1/3 tests prev=0 tail= left=1h0m0s'", cfg.Agent.Env).Return("\x1b[1mhalf done\x1b[0m\r\n", exitError(t, 2)).Once()
+	mockRunner.On("Run", mock.Anything, "agent 'step 2/3 tests prev=2 tail=half done left=1h0m0s'", cfg.Agent.Env).Return("DONE", nil).Once()
+
+	require.NoError(t, Run(context.Background(), cfg, mockRunner, prompt))
+	mockRunner.AssertExpectations(t)
+
+	t.Run("missing variable", func(t *testing.T) {
+		err := Run(context.Background(), cfg, new(MockRunner), "{{.Vars.missing}}")
+		require.ErrorContains(t, err, "failed to render the prompt of step 1")
+	})
+
+	t.Run("invalid template", func(t *testing.T) {
+		err := Run(context.Background(), cfg, new(MockRunner), "{{.Step")
+		require.ErrorContains(t, err, "invalid prompt template")
+	})
+}
+
+func TestRun_CarryOver(t *testing.T) {
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "agent '${PROMPT}'"},
+		Loop: config.LoopConfig{
+			MaxSteps:        3,
+			StopPhrase:      "DONE",
+			StopMode:        "suffix",
+			TimeoutDuration: time.Minute,
+		},
+		Input: config.InputConfig{
+			CarryOver: config.CarryOverConfig{Enabled: true, Lines: 1, MaxBytes: 1024},
+		},
+	}
+
+	var prompts []string
+	r := runnerFunc(func(command string) (string, error) {
+		prompts = append(prompts, command)
+		if len(prompts) == 2 {
+			return "DONE", nil
+		}
+		return "step one\nleft off in parser.go", nil
+	})
+
+	require.NoError(t, Run(context.Background(), cfg, r, "task"))
+	require.Len(t, prompts, 2)
+	require.NotContains(t, prompts[0], "Output of the previous step")
+	require.Contains(t, prompts[1], "task")
+	require.Contains(t, prompts[1], "## Output of the previous step")
+	require.Contains(t, prompts[1], "left off in parser.go")
+	require.NotContains(t, prompts[1], "step one")
+}
+
+func TestRun_Progress(t *testing.T) {
+	newConfig := func(stall int) *config.Config {
+		return &config.Config{
+			Agent: config.AgentConfig{Command: "agent --notes ${PROGRESS_FILE} '${PROMPT}'"},
+			Loop: config.LoopConfig{
+				MaxSteps:        5,
+				StopPhrase:      "DONE",
+				StopMode:        "suffix",
+				TimeoutDuration: time.Minute,
+			},
+			Input: config.InputConfig{
+				Progress: config.ProgressConfig{Enabled: true, StallSteps: stall},
+			},
+		}
+	}
+
+	t.Run("snapshots the file after every step", func(t *testing.T) {
+		run, err := runs.Create(t.TempDir(), runs.State{})
+		require.NoError(t, err)
+		path := filepath.Join(run.Dir, "progress.md")
+
+		var commands []string
+		r := runnerFunc(func(command string) (string, error) {
+			commands = append(commands, command)
+			if len(commands) == 2 {
+				return "DONE", nil
+			}
+			return "working", os.WriteFile(path, []byte("# Progress\n\n- parser done\n"), 0644)
+		})
+
+		require.NoError(t, Run(context.Background(), newConfig(0), r, "notes go in ${PROGRESS_FILE}", WithRun(run)))
+		require.Len(t, commands, 2)
+		require.Equal(t, fmt.Sprintf("agent --notes %s 'notes go in %s'", path, path), commands[0])
+
+		data, err := os.ReadFile(filepath.Join(run.Dir, runs.StepName(1, 1)+".progress.md"))
+		require.NoError(t, err)
+		require.Equal(t, "# Progress\n\n- parser done\n", string(data))
+	})
+
+	t.Run("keeps an existing file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "notes", "progress.md")
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte("earlier notes"), 0644))
+
+		cfg := newConfig(0)
+		cfg.Input.Progress.File = path
+		r := runnerFunc(func(command string) (string, error) { return "DONE", nil })
+		require.NoError(t, Run(context.Background(), cfg, r, "task"))
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "earlier notes", string(data))
+	})
+
+	t.Run("works with prompt templates", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "progress.md")
+		cfg := newConfig(0)
+		cfg.Input.Template = true
+		cfg.Input.Progress.File = path
+
+		var commands []string
+		r := runnerFunc(func(command string) (string, error) {
+			commands = append(commands, command)
+			return "DONE", nil
+		})
+		require.NoError(t, Run(context.Background(), cfg, r, "step {{.Step}}, notes in ${PROGRESS_FILE}"))
+		require.Equal(t, fmt.Sprintf("agent --notes %s 'step 1, notes in %s'", path, path), commands[0])
+	})
+
+	t.Run("ends the run when the file stops changing", func(t *testing.T) {
+		run, err := runs.Create(t.TempDir(), runs.State{})
+		require.NoError(t, err)
+		path := filepath.Join(run.Dir, "progress.md")
+
+		steps := 0
+		r := runnerFunc(func(command string) (string, error) {
+			steps++
+			if steps == 1 {
+				return "working", os.WriteFile(path, []byte("- started"), 0644)
+			}
+			return "still working", nil
+		})
+
+		err = Run(context.Background(), newConfig(2), r, "task", WithRun(run))
+		var stalled *NoProgressError
+		require.ErrorAs(t, err, &stalled)
+		require.Equal(t, 2, stalled.Steps)
+		require.Equal(t, 3, steps)
+		require.Equal(t, ReasonNoProgress, runReason(err))
+	})
+}
+
+func TestRun_Reload(t *testing.T) {
+	dir := t.TempDir()
+	promptFile := filepath.Join(dir, "task.md")
+	configFile := filepath.Join(dir, "clancy.yaml")
+	writeConfig := func(command, env string) {
+		yaml := fmt.Sprintf("agent:\n  command: %q\n  env:\n    MODE: %q\n"+
+			"loop:\n  max_steps: 5\n  stop_phrase: DONE\n"+
+			"input:\n  prompt: \"file:%s\"\n  reload: true\n", command, env, promptFile)
+		require.NoError(t, os.WriteFile(configFile, []byte(yaml), 0644))
+	}
+	writeConfig("agent '${PROMPT}'", "fast")
+	require.NoError(t, os.WriteFile(promptFile, []byte("# Task\nFix the parser."), 0644))
+
+	cfg, err := config.Load(configFile)
+	require.NoError(t, err)
+	prompt, err := cfg.ResolvePrompt()
+	require.NoError(t, err)
+
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "agent '# Task\nFix the parser.'", map[string]string{"MODE": "fast"}).Return("working", nil).Once()
+	// Nothing changed, the prompt is sent again as is.
+	mockRunner.On("Run", mock.Anything, "agent '# Task\nFix the parser.'", map[string]string{"MODE": "fast"}).Return("working", nil).Once().
+		Run(func(mock.Arguments) {
+			require.NoError(t, os.WriteFile(promptFile, []byte("# Task\nFix the lexer."), 0644))
+			writeConfig("other '${PROMPT}'", "slow")
+		})
+	mockRunner.On("Run", mock.Anything, "other '# Task\nFix the lexer.'", map[string]string{"MODE": "slow"}).Return("working", nil).Once().
+		Run(func(mock.Arguments) {
+			// A broken config keeps the current settings.
+			require.NoError(t, os.WriteFile(configFile, []byte("loop: ["), 0644))
+		})
+	mockRunner.On("Run", mock.Anything, "other '# Task\nFix the lexer.'", map[string]string{"MODE": "slow"}).Return("DONE", nil).Once()
+
+	obs := &recordingObserver{}
+	err = Run(context.Background(), cfg, mockRunner, prompt, WithConfigFile(configFile), WithObservers(obs))
+	require.NoError(t, err)
+	mockRunner.AssertExpectations(t)
+
+	require.Contains(t, obs.events, "reload 3 prompt, agent.command, agent.env")
+	require.Len(t, obs.reloads, 1)
+	require.Equal(t, []string{"- Fix the parser.", "+ Fix the lexer."}, obs.reloads[0].Diff)
+	require.Len(t, obs.warnings, 1)
+	require.Contains(t, obs.warnings[0], "failed to reload the config")
+}
+
+// runnerFunc is an AgentRunner that answers with a function of the command,
+// for tests that check the prompts the agent receives.
+type runnerFunc func(command string) (string, error)
+
+func (f runnerFunc) Run(ctx context.Context, command string, env map[string]string, out io.Writer) (string, error) {
+	return f(command)
+}
+
+// exitError runs a shell that exits with code to get a real *exec.ExitError.
+func exitError(t *testing.T, code int) error {
+	t.Helper()
+	err := exec.Command("sh", "-c", fmt.Sprintf("exit %d", code)).Run()
+	require.Error(t, err)
+	return err
+}
+
+func TestRun_OnExitCode(t *testing.T) {
+	newConfig := func() *config.Config {
+		return &config.Config{
+			Agent: config.AgentConfig{Command: "cmd"},
+			Loop: config.LoopConfig{
+				MaxSteps:        2,
+				StopPhrase:      "DONE",
+				TimeoutDuration: time.Minute,
+				OnExitCode: []config.ExitCodeRule{
+					{Codes: "2", Action: config.ExitActionFail, Min: 2, Max: 2},
+					{Codes: "3", Action: config.ExitActionSucceed, Min: 3, Max: 3},
+					{Codes: "10-20", Action: config.ExitActionRetry, Min: 10, Max: 20},
+				},
+			},
+		}
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		cfg := newConfig()
+		mockRunner := new(MockRunner)
+		mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("auth expired", exitError(t, 2)).Once()
+
+		err := Run(context.Background(), cfg, mockRunner, "p")
+		var exitCodeErr *ExitCodeError
+		require.ErrorAs(t, err, &exitCodeErr)
+		require.Equal(t, 2, exitCodeErr.ExitCode)
+		require.Equal(t, 1, exitCodeErr.Step)
+		mockRunner.AssertExpectations(t)
+	})
+
+	t.Run("succeed", func(t *testing.T) {
+		cfg := newConfig()
+		mockRunner := new(MockRunner)
+		mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("nothing to do", exitError(t, 3)).Once()
+
+		require.NoError(t, Run(context.Background(), cfg, mockRunner, "p"))
+		mockRunner.AssertExpectations(t)
+	})
+
+	t.Run("succeed is verified", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.Loop.Verify = "make test"
+		mockRunner := new(MockRunner)
+		mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("nothing to do", exitError(t, 3)).Twice()
+		mockRunner.On("Run", mock.Anything, "make test", cfg.Agent.Env).Return("FAIL", exitError(t, 1)).Twice()
+
+		var maxSteps *MaxStepsError
+		require.ErrorAs(t, Run(context.Background(), cfg, mockRunner, "p"), &maxSteps)
+		mockRunner.AssertExpectations(t)
+	})
+
+	t.Run("retry same step", func(t *testing.T) {
+		// Two retries do not use up the two available steps.
+		cfg := newConfig()
+		mockRunner := new(MockRunner)
+		mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("flaky", exitError(t, 15)).Twice()
+		mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("working", nil).Once()
+		mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("DONE", nil).Once()
+
+		require.NoError(t, Run(context.Background(), cfg, mockRunner, "p"))
+		mockRunner.AssertExpectations(t)
+	})
+
+	t.Run("retries are limited", func(t *testing.T) {
+		// Each step is repeated maxStepRetries times, then counts.
+		cfg := newConfig()
+		mockRunner := new(MockRunner)
+		mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("flaky", exitError(t, 15)).Times(2 * (maxStepRetries + 1))
+
+		var maxSteps *MaxStepsError
+		require.ErrorAs(t, Run(context.Background(), cfg, mockRunner, "p"), &maxSteps)
+		mockRunner.AssertExpectations(t)
+	})
+}
+
+func TestRun_MaxConsecutiveFailures(t *testing.T) {
+	// Scenario: A success resets the counter, then three failures in a row
+	// trip the breaker long before max steps.
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:               20,
+			StopPhrase:             "DONE",
+			TimeoutDuration:        time.Minute,
+			MaxConsecutiveFailures: 3,
+		},
+	}
+
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("", exitError(t, 1)).Twice()
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("working", nil).Once()
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("", exitError(t, 1)).Twice()
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("", fmt.Errorf("invalid API key")).Once()
+
+	err := Run(context.Background(), cfg, mockRunner, "p")
+	var failuresErr *ConsecutiveFailuresError
+	require.ErrorAs(t, err, &failuresErr)
+	require.Equal(t, 3, failuresErr.Failures)
+	require.Contains(t, err.Error(), "invalid API key")
+	mockRunner.AssertExpectations(t)
+}
+
+func TestRun_MaxConsecutiveFailures_StopPhrase(t *testing.T) {
+	// An agent printing the stop phrase ran, even if it exited with an error.
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:               5,
+			StopPhrase:             "DONE",
+			TimeoutDuration:        time.Minute,
+			MaxConsecutiveFailures: 2,
+		},
+	}
+
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("", exitError(t, 1)).Once()
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("DONE", exitError(t, 1)).Once()
+
+	require.NoError(t, Run(context.Background(), cfg, mockRunner, "p"))
+	mockRunner.AssertExpectations(t)
+}
+
+func TestRun_WithRun(t *testing.T) {
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:        5,
+			StopPhrase:      "DONE",
+			StopMode:        "exact",
+			TimeoutDuration: time.Minute,
+		},
+	}
+
+	t.Run("persists every step", func(t *testing.T) {
+		run, err := runs.Create(t.TempDir(), runs.State{})
+		require.NoError(t, err)
+
+		mockRunner := new(MockRunner)
+		mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("working...", nil).Once()
+		mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("DONE", nil).Once()
+
+		require.NoError(t, Run(context.Background(), cfg, mockRunner, "p", WithRun(run)))
+		mockRunner.AssertExpectations(t)
+
+		saved, err := runs.Open(filepath.Dir(run.Dir), run.State.ID)
+		require.NoError(t, err)
+		require.Equal(t, runs.StatusSucceeded, saved.State.Status)
+		require.Equal(t, 3, saved.State.NextStep)
+		require.Len(t, saved.State.Steps, 2)
+		require.Equal(t, 2, saved.State.Steps[1].Step)
+
+		txt, err := os.ReadFile(filepath.Join(run.Dir, "step-02.txt"))
+		require.NoError(t, err)
+		require.Equal(t, "DONE", string(txt))
+		require.FileExists(t, filepath.Join(run.Dir, "step-01.meta.json"))
+	})
+
+	t.Run("resumes from the next step", func(t *testing.T) {
+		run, err := runs.Create(t.TempDir(), runs.State{NextStep: 5})
+		require.NoError(t, err)
+
+		mockRunner := new(MockRunner)
+		mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("working...", nil).Once()
+
+		err = Run(context.Background(), cfg, mockRunner, "p", WithRun(run))
+		require.ErrorContains(t, err, "max steps (5) reached")
+		mockRunner.AssertExpectations(t)
+		require.Equal(t, runs.StatusFailed, run.State.Status)
+		require.Equal(t, 5, run.State.Steps[0].Step)
+	})
+
+	t.Run("uses the remaining budget", func(t *testing.T) {
+		run, err := runs.Create(t.TempDir(), runs.State{NextStep: 2, Elapsed: runs.Duration(time.Minute)})
+		require.NoError(t, err)
+
+		mockRunner := new(MockRunner)
+		err = Run(context.Background(), cfg, mockRunner, "p", WithRun(run))
+		require.ErrorContains(t, err, "global timeout reached")
+		mockRunner.AssertNotCalled(t, "Run", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+// recordingObserver records the notifications it receives.
+type recordingObserver struct {
+	NopObserver
+	events   []string
+	output   strings.Builder
+	reloads  []Reload
+	warnings []string
+}
+
+func (r *recordingObserver) OnRunStart(info RunInfo) {
+	r.events = append(r.events, fmt.Sprintf("run_start %d/%d", info.FirstStep, info.MaxSteps))
+}
+
+func (r *recordingObserver) OnReload(step int, reload Reload) {
+	r.events = append(r.events, fmt.Sprintf("reload %d %s", step, reload))
+	r.reloads = append(r.reloads, reload)
+}
+
+func (r *recordingObserver) OnWarning(err error) {
+	r.warnings = append(r.warnings, err.Error())
+}
+
+func (r *recordingObserver) OnStepStart(step int) {
+	r.events = append(r.events, fmt.Sprintf("step_start %d", step))
+}
+
+func (r *recordingObserver) OnStepOutput(step int, data []byte) {
+	r.output.Write(data)
+}
+
+func (r *recordingObserver) OnStepEnd(res StepResult, stopMatched bool) {
+	r.events = append(r.events, fmt.Sprintf("step_end %d %v", res.Step, stopMatched))
+}
+
+func (r *recordingObserver) OnCooldown(step int, delay time.Duration) {
+	r.events = append(r.events, fmt.Sprintf("cooldown %d %s", step, delay))
+}
+
+func (r *recordingObserver) OnRetry(step int) {
+	r.events = append(r.events, fmt.Sprintf("retry %d", step))
+}
+
+func (r *recordingObserver) OnStopFound(step int) {
+	r.events = append(r.events, fmt.Sprintf("stop_found %d", step))
+}
+
+func (r *recordingObserver) OnRunEnd(summary RunSummary) {
+	r.events = append(r.events, fmt.Sprintf("run_end %s %d", summary.Reason, summary.Steps))
+}
+
+func TestRun_Observers(t *testing.T) {
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop: config.LoopConfig{
+			MaxSteps:        3,
+			StopPhrase:      "DONE",
+			StopMode:        "exact",
+			TimeoutDuration: time.Minute,
+			Delay:           "10ms",
+			DelayDuration:   10 * time.Millisecond,
+		},
+	}
+
+	mockRunner := new(MockRunner)
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("working...", nil).Once()
+	mockRunner.On("Run", mock.Anything, "cmd", cfg.Agent.Env).Return("DONE", nil).Once()
+
+	obs := &recordingObserver{}
+	require.NoError(t, Run(context.Background(), cfg, mockRunner, "p", WithObservers(obs)))
+	require.Equal(t, []string{
+		"run_start 1/3",
+		"step_start 1",
+		"step_end 1 false",
+		"retry 1",
+		"cooldown 1 10ms",
+		"step_start 2",
+		"step_end 2 true",
+		"stop_found 2",
+		"run_end success 2",
+	}, obs.events)
+	require.Equal(t, "working...DONE", obs.output.String())
+}
+
+func TestRunReason(t *testing.T) {
+	require.Equal(t, ReasonSuccess, runReason(nil))
+	require.Equal(t, ReasonInterrupted, runReason(ErrInterrupted))
+	require.Equal(t, ReasonTimeout, runReason(fmt.Errorf("%w during delay", ErrTimeout)))
+	require.Equal(t, ReasonMaxSteps, runReason(&MaxStepsError{MaxSteps: 3}))
+	require.Equal(t, ReasonAborted, runReason(&AbortError{Step: 1}))
+	require.Equal(t, ReasonExitCode, runReason(&ExitCodeError{Step: 1}))
+	require.Equal(t, ReasonCircuitBreaker, runReason(&ConsecutiveFailuresError{Failures: 3}))
+	require.Equal(t, ReasonError, runReason(fmt.Errorf("step 1 timed out")))
+}
@@ -0,0 +1,36 @@
+//go:build !windows
+
+package loop
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/eduardolat/clancy/internal/config"
+	"github.com/eduardolat/clancy/internal/runner"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun_StreamStop_ShutdownOutput(t *testing.T) {
+	// The agent prints more while shutting down, which no longer ends with
+	// the stop phrase. The step still succeeds.
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "trap 'echo Terminated by signal; exit 0' TERM; echo DONE; sleep 5 & wait"},
+		Loop: config.LoopConfig{
+			MaxSteps:                1,
+			StopPhrase:              "DONE",
+			StopMode:                "suffix",
+			StreamStop:              true,
+			StreamStopQuietDuration: 100 * time.Millisecond,
+		},
+	}
+	r := runner.NewRealRunner()
+	r.Stdout = io.Discard
+	r.StopCheck, r.StopQuiet = StreamStop(cfg)
+
+	start := time.Now()
+	require.NoError(t, Run(context.Background(), cfg, r, "prompt"))
+	require.Less(t, time.Since(start), 4*time.Second)
+}
@@ -0,0 +1,170 @@
+package loop
+
+import (
+	"errors"
+	"time"
+)
+
+// Reasons a run finished, as reported to OnRunEnd.
+const (
+	ReasonSuccess        = "success"         // The stop condition was met
+	ReasonMaxSteps       = "max_steps"       // Every step ran without success
+	ReasonTimeout        = "timeout"         // The global timeout expired
+	ReasonAborted        = "aborted"         // The agent printed an abort phrase
+	ReasonExitCode       = "exit_code"       // An on_exit_code rule failed the run
+	ReasonCircuitBreaker = "circuit_breaker" // Too many consecutive failures
+	ReasonNoProgress     = "no_progress"     // The progress file stopped changing
+	ReasonInterrupted    = "interrupted"     // Stopped on request
+	ReasonError          = "error"           // Anything else
+)
+
+// RunInfo describes a run as it starts.
+type RunInfo struct {
+	RunID     string // Empty when the run is not persisted
+	FirstStep int    // Greater than 1 when a run is resumed
+	MaxSteps  int
+	Timeout   time.Duration // Remaining global timeout, zero for none
+}
+
+// RunSummary describes how a run ended.
+type RunSummary struct {
+	Reason  string        // One of the Reason constants
+	Err     error         // As returned by Run
+	Steps   int           // Steps run in this session
+	Elapsed time.Duration // Without the time paused with pause_freezes_timeout
+	Last    StepResult    // The last step run, if any
+}
+
+// Observer is notified of the progress of Run, e.g. to report it. Methods are
+// called from the goroutine running the loop, except OnStepOutput, which is
+// called by the runner while the agent runs. They must not block.
+//
+// Embed NopObserver to implement only the notifications you care about.
+type Observer interface {
+	OnRunStart(info RunInfo)
+	// OnReload reports the settings input.reload changed, before the
+	// OnStepStart of the first step using them.
+	OnReload(step int, reload Reload)
+	OnStepStart(step int)
+	// OnStepOutput receives the agent output as it is produced. data must
+	// not be retained after the call returns.
+	OnStepOutput(step int, data []byte)
+	OnStepEnd(res StepResult, stopMatched bool)
+
+	// Outcomes of a step, reported after OnStepEnd.
+	OnStepTimeout(step int, timeout time.Duration)
+	OnIdleTimeout(step int, timeout time.Duration)
+	OnStepError(step int, err error)
+	OnAbort(step int, phrase string)
+	OnCircuitBreaker(failures int)
+	OnNoProgress(step, steps int)
+	OnExitCode(step, code int, action string)
+	OnVerify(step int, command string)
+	OnVerifyEnd(step int, err error)
+	OnStopFound(step int)
+	OnRetry(step int)
+
+	// Waits between steps.
+	OnCooldown(step int, delay time.Duration)
+	OnBackoff(step, rule, attempt int, delay time.Duration)
+	OnBackoffTick(step int, remaining time.Duration)
+	OnPause(step int, frozen bool)
+	OnResume(step int)
+
+	// OnWarning reports a problem that does not stop the loop, such as a
+	// failure to save the run state.
+	OnWarning(err error)
+	OnRunEnd(summary RunSummary)
+}
+
+// NopObserver implements every Observer method as a no-op.
+type NopObserver struct{}
+
+var _ Observer = NopObserver{}
+
+func (NopObserver) OnRunStart(RunInfo)                     {}
+func (NopObserver) OnReload(int, Reload)                   {}
+func (NopObserver) OnStepStart(int)                        {}
+func (NopObserver) OnStepOutput(int, []byte)               {}
+func (NopObserver) OnStepEnd(StepResult, bool)             {}
+func (NopObserver) OnStepTimeout(int, time.Duration)       {}
+func (NopObserver) OnIdleTimeout(int, time.Duration)       {}
+func (NopObserver) OnStepError(int, error)                 {}
+func (NopObserver) OnAbort(int, string)                    {}
+func (NopObserver) OnCircuitBreaker(int)                   {}
+func (NopObserver) OnNoProgress(int, int)                  {}
+func (NopObserver) OnExitCode(int, int, string)            {}
+func (NopObserver) OnVerify(int, string)                   {}
+func (NopObserver) OnVerifyEnd(int, error)                 {}
+func (NopObserver) OnStopFound(int)                        {}
+func (NopObserver) OnRetry(int)                            {}
+func (NopObserver) OnCooldown(int, time.Duration)          {}
+func (NopObserver) OnBackoff(int, int, int, time.Duration) {}
+func (NopObserver) OnBackoffTick(int, time.Duration)       {}
+func (NopObserver) OnPause(int, bool)                      {}
+func (NopObserver) OnResume(int)                           {}
+func (NopObserver) OnWarning(error)                        {}
+func (NopObserver) OnRunEnd(RunSummary)                    {}
+
+// WithObservers notifies every observer of the progress of the loop. Without
+// observers Run is silent, use a Console for the usual terminal output.
+func WithObservers(observers ...Observer) Option {
+	return func(o *options) {
+		o.observers = append(o.observers, observers...)
+	}
+}
+
+// notify calls fn for every observer.
+func (o *options) notify(fn func(Observer)) {
+	for _, obs := range o.observers {
+		fn(obs)
+	}
+}
+
+// warn reports a problem that does not stop the loop.
+func (o *options) warn(err error) {
+	o.notify(func(obs Observer) { obs.OnWarning(err) })
+}
+
+// stepOutput forwards the output of a step to the observers.
+type stepOutput struct {
+	o    *options
+	step int
+}
+
+func (w stepOutput) Write(p []byte) (int, error) {
+	w.o.notify(func(obs Observer) { obs.OnStepOutput(w.step, p) })
+	return len(p), nil
+}
+
+// runReason maps the error returned by Run to the reason reported to
+// OnRunEnd.
+func runReason(err error) string {
+	var (
+		maxSteps *MaxStepsError
+		abort    *AbortError
+		exitCode *ExitCodeError
+		failures *ConsecutiveFailuresError
+		stalled  *NoProgressError
+	)
+	switch {
+	case err == nil:
+		return ReasonSuccess
+	case errors.Is(err, ErrInterrupted):
+		return ReasonInterrupted
+	case errors.Is(err, ErrTimeout):
+		return ReasonTimeout
+	case errors.As(err, &maxSteps):
+		return ReasonMaxSteps
+	case errors.As(err, &abort):
+		return ReasonAborted
+	case errors.As(err, &exitCode):
+		return ReasonExitCode
+	case errors.As(err, &failures):
+		return ReasonCircuitBreaker
+	case errors.As(err, &stalled):
+		return ReasonNoProgress
+	default:
+		return ReasonError
+	}
+}
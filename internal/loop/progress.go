@@ -0,0 +1,100 @@
+package loop
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/eduardolat/clancy/internal/config"
+	"github.com/eduardolat/clancy/internal/runs"
+)
+
+// ProgressPlaceholder is replaced with the path of the progress file in the
+// prompt and the agent command.
+const ProgressPlaceholder = "${PROGRESS_FILE}"
+
+// progressFileName is the progress file in the run directory, unless
+// input.progress.file says otherwise.
+const progressFileName = "progress.md"
+
+// progressHeader is the initial content of a new progress file.
+const progressHeader = "# Progress\n\n"
+
+// NoProgressError is returned by Run when the progress file did not change
+// for input.progress.stall_steps steps in a row.
+type NoProgressError struct {
+	Steps int
+	Path  string
+}
+
+func (e *NoProgressError) Error() string {
+	return fmt.Sprintf("no progress: %s did not change for %d steps", e.Path, e.Steps)
+}
+
+// progressPath returns where the progress file of run goes.
+func progressPath(c config.ProgressConfig, run *runs.Run) string {
+	switch {
+	case c.File != "":
+		return c.File
+	case run != nil:
+		return filepath.Join(run.Dir, progressFileName)
+	default:
+		return progressFileName
+	}
+}
+
+// createProgress creates the progress file at path, unless it exists, e.g.
+// when a run is resumed.
+func createProgress(path string) error {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create the progress file: %w", err)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create the progress file: %w", err)
+	}
+	_, err = f.WriteString(progressHeader)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create the progress file: %w", err)
+	}
+	return nil
+}
+
+// progressTracker detects a progress file that stopped changing.
+type progressTracker struct {
+	path      string
+	last      string
+	unchanged int // Steps in a row without a change
+}
+
+// read returns the current content of the progress file. A missing file is
+// empty, the agent may have deleted it.
+func (p *progressTracker) read() (string, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("failed to read the progress file: %w", err)
+	}
+	return string(data), nil
+}
+
+// update records the content of the file after a step and returns how many
+// steps in a row it has not changed.
+func (p *progressTracker) update(content string) int {
+	if content == p.last {
+		p.unchanged++
+	} else {
+		p.unchanged = 0
+	}
+	p.last = content
+	return p.unchanged
+}
@@ -0,0 +1,98 @@
+package loop
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/eduardolat/clancy/internal/ansi"
+	"github.com/eduardolat/clancy/internal/config"
+	"github.com/eduardolat/clancy/internal/runs"
+)
+
+// promptTailLines is how many lines of the previous step's output are
+// available to prompt templates as .PreviousOutputTail.
+const promptTailLines = 50
+
+// PromptData holds the variables of a prompt template, enabled with
+// input.template.
+type PromptData struct {
+	Step               int
+	MaxSteps           int
+	Elapsed            time.Duration     // Since the run started, earlier sessions included, frozen pauses not
+	Remaining          time.Duration     // Left of the global timeout, zero without one
+	PreviousOutputTail string            // Last lines of the previous step, without ANSI escape codes
+	PreviousExitCode   int               // Exit code of the previous step, 0 in the first one
+	RunID              string            // Empty when the run is not persisted
+	Vars               map[string]string // input.vars
+}
+
+// ParsePrompt parses a prompt template. Using a variable that does not
+// exist, including a missing input.vars entry, fails the rendering.
+func ParsePrompt(prompt string) (*template.Template, error) {
+	return template.New("prompt").Option("missingkey=error").Parse(prompt)
+}
+
+// renderPrompt executes a prompt template for one step.
+func renderPrompt(tmpl *template.Template, data PromptData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// lastStep returns the exit code and output of the last step of a resumed
+// run, so the first step of the new session can still refer to them.
+func lastStep(run *runs.Run) (exitCode int, output string) {
+	if run == nil || len(run.State.Steps) == 0 {
+		return 0, ""
+	}
+	rec := run.State.Steps[len(run.State.Steps)-1]
+	name := runs.StepName(rec.Step, run.Attempts(rec.Step)) + ".txt"
+	data, err := os.ReadFile(filepath.Join(run.Dir, name))
+	if err != nil {
+		return rec.ExitCode, ""
+	}
+	return rec.ExitCode, string(data)
+}
+
+// outputTail returns the end of a step's output for a prompt.
+func outputTail(output string) string {
+	return ansi.Tail(ansi.Strip(output), promptTailLines)
+}
+
+// carryOver builds the prompt section that passes the end of the previous
+// step's output to the next one, as set in input.carry_over. It is empty
+// when there is nothing to carry over.
+func carryOver(c config.CarryOverConfig, output string) string {
+	text := ansi.Strip(output)
+	if c.StartMarker != "" {
+		if i := strings.LastIndex(text, c.StartMarker); i >= 0 {
+			text = text[i+len(c.StartMarker):]
+			if j := strings.Index(text, c.EndMarker); c.EndMarker != "" && j >= 0 {
+				text = text[:j]
+			}
+		}
+	}
+
+	text = ansi.Tail(text, c.Lines)
+	if len(text) > c.MaxBytes {
+		text = text[len(text)-c.MaxBytes:]
+		// Do not start in the middle of a character.
+		for text != "" && !utf8.RuneStart(text[0]) {
+			text = text[1:]
+		}
+	}
+	text = strings.Trim(text, "\n")
+	if strings.TrimSpace(text) == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("\n\n## Output of the previous step\n\n"+
+		"For context, this is how the previous step ended:\n\n```\n%s\n```\n", text)
+}
@@ -0,0 +1,45 @@
+package loop
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/eduardolat/clancy/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCarryOver(t *testing.T) {
+	c := config.CarryOverConfig{Enabled: true, Lines: 2, MaxBytes: 1024}
+
+	t.Run("tail", func(t *testing.T) {
+		got := carryOver(c, "one\r\n\x1b[32mtwo\x1b[0m\r\nthree\r\n\r\n")
+		require.Contains(t, got, "## Output of the previous step")
+		require.Contains(t, got, "```\ntwo\nthree\n```")
+		require.NotContains(t, got, "one")
+	})
+
+	t.Run("nothing to carry over", func(t *testing.T) {
+		require.Empty(t, carryOver(c, ""))
+		require.Empty(t, carryOver(c, "\x1b[0m\r\n  \r\n"))
+	})
+
+	t.Run("markers", func(t *testing.T) {
+		c := c
+		c.Lines = 10
+		c.StartMarker, c.EndMarker = "<notes>", "</notes>"
+		output := "<notes>old</notes>\nwork\n<notes>\nfixed the parser\nnext: tests\n</notes>\nDONE"
+		got := carryOver(c, output)
+		require.Contains(t, got, "```\nfixed the parser\nnext: tests\n```")
+		require.NotContains(t, got, "DONE")
+
+		// Without the markers, the tail is used.
+		require.Contains(t, carryOver(c, "just work"), "just work")
+	})
+
+	t.Run("size limit", func(t *testing.T) {
+		c := c
+		c.Lines, c.MaxBytes = 100, 9
+		got := carryOver(c, strings.Repeat("é", 20))
+		require.Contains(t, got, "```\néééé\n```") // The 9th byte from the end is in the middle of a character
+	})
+}
@@ -0,0 +1,138 @@
+package loop
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/eduardolat/clancy/internal/config"
+)
+
+// maxDiffLines is how many changed lines of a reloaded prompt are reported.
+const maxDiffLines = 10
+
+// Reload describes what input.reload picked up before a step.
+type Reload struct {
+	Prompt  bool     // The prompt changed
+	Diff    []string // Changed lines of the prompt, prefixed with "- " or "+ "
+	Command bool     // agent.command changed
+	Env     bool     // agent.env changed
+}
+
+// WithConfigFile sets the file the config was loaded from. With input.reload
+// agent.command and agent.env are read again from it before every step,
+// along with the prompt.
+func WithConfigFile(path string) Option {
+	return func(o *options) {
+		o.configFile = path
+	}
+}
+
+// source holds what input.reload reads again before every step.
+type source struct {
+	prompt  string
+	command string
+	env     map[string]string
+}
+
+// reload reads the prompt again and, when configFile is set, the agent
+// settings. Without configFile only the prompt of cfg is resolved again.
+func reload(cfg *config.Config, configFile string) (source, error) {
+	if configFile != "" {
+		c, err := config.Load(configFile)
+		if err != nil {
+			return source{}, fmt.Errorf("failed to reload the config: %w", err)
+		}
+		cfg = c
+	}
+	prompt, err := cfg.ResolvePrompt()
+	if err != nil {
+		return source{}, fmt.Errorf("failed to reload the prompt: %w", err)
+	}
+	return source{prompt: prompt, command: cfg.Agent.Command, env: cfg.Agent.Env}, nil
+}
+
+// changes compares a reloaded source with the current one.
+func (s source) changes(next source) Reload {
+	r := Reload{
+		Prompt:  next.prompt != s.prompt,
+		Command: next.command != s.command,
+		Env:     !maps.Equal(next.env, s.env),
+	}
+	if r.Prompt {
+		r.Diff = diffLines(s.prompt, next.prompt, maxDiffLines)
+	}
+	return r
+}
+
+// String lists the settings that changed, e.g. "prompt, agent.env".
+func (r Reload) String() string {
+	var what []string
+	if r.Prompt {
+		what = append(what, "prompt")
+	}
+	if r.Command {
+		what = append(what, "agent.command")
+	}
+	if r.Env {
+		what = append(what, "agent.env")
+	}
+	return strings.Join(what, ", ")
+}
+
+// changed reports whether anything was reloaded.
+func (r Reload) changed() bool {
+	return r.Prompt || r.Command || r.Env
+}
+
+// diffLines returns a short line diff between two texts: removed lines
+// prefixed with "- ", added ones with "+ ". Past limit lines the rest is
+// summarized in a last line.
+func diffLines(before, after string, limit int) []string {
+	a, b := strings.Split(before, "\n"), strings.Split(after, "\n")
+
+	// Only the middle part, between the common prefix and suffix, changed.
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	// Longest common subsequence of the lines left, lcs[i][j] for a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "- "+a[i])
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+
+	if len(diff) > limit {
+		more := len(diff) - limit + 1
+		diff = append(diff[:limit-1], fmt.Sprintf("... %d more changed lines", more))
+	}
+	return diff
+}
@@ -0,0 +1,34 @@
+package loop
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffLines(t *testing.T) {
+	t.Run("changed line", func(t *testing.T) {
+		before := "# Task\nFix the parser.\nRun the tests."
+		after := "# Task\nFix the lexer.\nRun the tests."
+		require.Equal(t, []string{"- Fix the parser.", "+ Fix the lexer."}, diffLines(before, after, 10))
+	})
+
+	t.Run("added and removed lines", func(t *testing.T) {
+		before := "one\ntwo\nthree"
+		after := "one\nthree\nfour"
+		require.Equal(t, []string{"- two", "+ four"}, diffLines(before, after, 10))
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		after := strings.Repeat("line\n", 20)
+		diff := diffLines("", after, 5)
+		require.Len(t, diff, 5)
+		require.Equal(t, "... 16 more changed lines", diff[4])
+	})
+}
+
+func TestReload_String(t *testing.T) {
+	require.Equal(t, "prompt, agent.env", Reload{Prompt: true, Env: true}.String())
+	require.Empty(t, Reload{}.String())
+}
@@ -0,0 +1,211 @@
+// Package metrics exposes the progress of a run as Prometheus metrics, served
+// on /metrics by the HTTP API.
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eduardolat/clancy/internal/config"
+	"github.com/eduardolat/clancy/internal/loop"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Outcomes of a step, the values of the "reason" label. Every step gets
+// exactly one.
+const (
+	OutcomeStopFound = "stop_found"
+	OutcomeRetry     = "retry" // The stop phrase was not found
+	OutcomeError     = "error"
+	OutcomeTimeout   = "timeout" // Step or idle timeout
+)
+
+// Metrics is a loop.Observer recording the metrics of a run.
+type Metrics struct {
+	loop.NopObserver
+
+	registry *prometheus.Registry
+	steps    prometheus.Counter
+	outcomes *prometheus.CounterVec
+	duration prometheus.Histogram
+	output   prometheus.Histogram
+	step     prometheus.Gauge
+
+	control *loop.Control
+
+	mu      sync.Mutex
+	outcome string // Outcome of the current step, empty outside of a step
+}
+
+var _ loop.Observer = (*Metrics)(nil)
+
+// New creates the metrics of a run of the config at configPath. Every metric
+// is labeled with the config name (the file name without extension) and the
+// agent program (the first word of command). The remaining timeout is read
+// from control, which must be the one the loop runs with.
+func New(configPath, command string, control *loop.Control) *Metrics {
+	labels := prometheus.Labels{
+		"config":  ConfigName(configPath),
+		"command": Program(command),
+	}
+	m := &Metrics{
+		control:  control,
+		registry: prometheus.NewRegistry(),
+		steps: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "clancy_steps_total",
+			Help:        "Number of agent invocations.",
+			ConstLabels: labels,
+		}),
+		outcomes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "clancy_step_outcomes_total",
+			Help:        "Step outcomes by reason: stop_found, retry, error or timeout.",
+			ConstLabels: labels,
+		}, []string{"reason"}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "clancy_step_duration_seconds",
+			Help:        "Duration of the agent invocations.",
+			ConstLabels: labels,
+			Buckets:     []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+		}),
+		output: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "clancy_step_output_bytes",
+			Help:        "Size of the agent output of a step.",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(1024, 4, 8), // 1KiB to 16MiB
+		}),
+		step: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "clancy_current_step",
+			Help:        "The step being run.",
+			ConstLabels: labels,
+		}),
+	}
+	remaining := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "clancy_timeout_remaining_seconds",
+		Help:        "Remaining global timeout budget, +Inf without a timeout.",
+		ConstLabels: labels,
+	}, m.remaining)
+
+	// Report every outcome from the start, so rates work from the first
+	// scrape.
+	for _, reason := range []string{OutcomeStopFound, OutcomeRetry, OutcomeError, OutcomeTimeout} {
+		m.outcomes.WithLabelValues(reason)
+	}
+	m.registry.MustRegister(m.steps, m.outcomes, m.duration, m.output, m.step, remaining)
+	return m
+}
+
+// ConfigName returns the name of a config file without directory and
+// extension, e.g. "clancy" for "./clancy.yaml".
+func ConfigName(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// Program returns the program an agent command runs, e.g. "claude" for
+// "/usr/bin/claude -p '${PROMPT}'". The full command would make a long and
+// unwieldy label.
+func Program(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return ""
+	}
+	return filepath.Base(fields[0])
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) remaining() float64 {
+	left, ok := m.control.Remaining()
+	if !ok {
+		return math.Inf(1)
+	}
+	return left.Seconds()
+}
+
+// settle sets the outcome of the current step. A step ends as a retry unless
+// it timed out or failed, and finding the stop phrase ends the run whatever
+// happened before.
+func (m *Metrics) settle(outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.outcome == "" || m.outcome == OutcomeRetry || outcome == OutcomeStopFound {
+		m.outcome = outcome
+	}
+}
+
+// record counts the outcome of the current step once it is final, that is
+// when the loop moves on from the step. It does nothing when it was already
+// counted.
+func (m *Metrics) record() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.outcome != "" {
+		m.outcomes.WithLabelValues(m.outcome).Inc()
+		m.outcome = ""
+	}
+}
+
+func (m *Metrics) OnStepStart(step int) {
+	m.record()
+	m.steps.Inc()
+	m.step.Set(float64(step))
+}
+
+func (m *Metrics) OnStepEnd(res loop.StepResult, stopMatched bool) {
+	m.duration.Observe(res.Duration.Seconds())
+	m.output.Observe(float64(len(res.Output)))
+	m.settle(OutcomeRetry)
+}
+
+func (m *Metrics) OnStepTimeout(step int, timeout time.Duration) {
+	m.settle(OutcomeTimeout)
+}
+
+func (m *Metrics) OnIdleTimeout(step int, timeout time.Duration) {
+	m.settle(OutcomeTimeout)
+}
+
+func (m *Metrics) OnStepError(step int, err error) {
+	m.settle(OutcomeError)
+}
+
+func (m *Metrics) OnAbort(step int, phrase string) {
+	m.settle(OutcomeError)
+	m.record()
+}
+
+func (m *Metrics) OnExitCode(step, code int, action string) {
+	if action == config.ExitActionFail {
+		m.settle(OutcomeError)
+		m.record()
+	}
+}
+
+func (m *Metrics) OnStopFound(step int) {
+	m.settle(OutcomeStopFound)
+	m.record()
+}
+
+func (m *Metrics) OnRetry(step int) {
+	m.record()
+}
+
+func (m *Metrics) OnCooldown(step int, delay time.Duration) {
+	m.record()
+}
+
+func (m *Metrics) OnBackoff(step, rule, attempt int, delay time.Duration) {
+	m.record()
+}
+
+func (m *Metrics) OnRunEnd(summary loop.RunSummary) {
+	m.record()
+}
@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/eduardolat/clancy/internal/config"
+	"github.com/eduardolat/clancy/internal/loop"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNames(t *testing.T) {
+	require.Equal(t, "clancy", ConfigName("./configs/clancy.yaml"))
+	require.Equal(t, "claude", Program("/usr/bin/claude -p '${PROMPT}'"))
+	require.Equal(t, "", Program("  "))
+}
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	m := New("clancy.yaml", "opencode run '${PROMPT}'", nil)
+
+	// Without a timeout the budget is unlimited.
+	require.Contains(t, scrape(t, m), `clancy_timeout_remaining_seconds{command="opencode",config="clancy"} +Inf`)
+
+	m.OnRunStart(loop.RunInfo{MaxSteps: 5})
+	m.OnStepStart(1)
+	m.OnStepEnd(loop.StepResult{Step: 1, Duration: 3 * time.Second, Output: "hello"}, false)
+	m.OnRetry(1)
+	m.OnCooldown(1, time.Hour)
+
+	// The outcome is counted as soon as the loop moves on from the step,
+	// not when the next one starts.
+	require.Contains(t, scrape(t, m), `clancy_step_outcomes_total{command="opencode",config="clancy",reason="retry"} 1`)
+
+	m.OnStepStart(2)
+	m.OnStepEnd(loop.StepResult{Step: 2, Duration: 90 * time.Second}, false)
+	m.OnStepError(2, errors.New("boom"))
+	m.OnRetry(2)
+	m.OnStepStart(3)
+	m.OnStepEnd(loop.StepResult{Step: 3, Duration: time.Minute}, false)
+	m.OnIdleTimeout(3, time.Minute)
+	m.OnRetry(3)
+	m.OnStepStart(4)
+	m.OnStepEnd(loop.StepResult{Step: 4, Duration: time.Second}, true)
+	m.OnStopFound(4)
+	m.OnRunEnd(loop.RunSummary{})
+
+	out := scrape(t, m)
+	require.Contains(t, out, `clancy_steps_total{command="opencode",config="clancy"} 4`)
+	require.Contains(t, out, `clancy_current_step{command="opencode",config="clancy"} 4`)
+	require.Contains(t, out, `clancy_step_outcomes_total{command="opencode",config="clancy",reason="retry"} 1`)
+	require.Contains(t, out, `clancy_step_outcomes_total{command="opencode",config="clancy",reason="error"} 1`)
+	require.Contains(t, out, `clancy_step_outcomes_total{command="opencode",config="clancy",reason="timeout"} 1`)
+	require.Contains(t, out, `clancy_step_outcomes_total{command="opencode",config="clancy",reason="stop_found"} 1`)
+	require.Contains(t, out, `clancy_step_duration_seconds_count{command="opencode",config="clancy"} 4`)
+	require.Contains(t, out, `clancy_step_duration_seconds_sum{command="opencode",config="clancy"} 154`)
+	require.Contains(t, out, `clancy_step_output_bytes_sum{command="opencode",config="clancy"} 5`)
+}
+
+func TestMetrics_ExitCodeFail(t *testing.T) {
+	m := New("clancy.yaml", "opencode", nil)
+	m.OnStepStart(1)
+	m.OnStepEnd(loop.StepResult{Step: 1, ExitCode: 2}, false)
+	m.OnExitCode(1, 2, config.ExitActionFail)
+	m.OnRunEnd(loop.RunSummary{})
+
+	out := scrape(t, m)
+	require.Contains(t, out, `clancy_step_outcomes_total{command="opencode",config="clancy",reason="error"} 1`)
+	require.Contains(t, out, `clancy_step_outcomes_total{command="opencode",config="clancy",reason="retry"} 0`)
+}
+
+func TestMetrics_FinalBeforeNextStep(t *testing.T) {
+	m := New("clancy.yaml", "opencode", nil)
+
+	// A failed verification is retried without OnRetry.
+	m.OnStepStart(1)
+	m.OnStepEnd(loop.StepResult{Step: 1}, true)
+	m.OnVerifyEnd(1, errors.New("tests failed"))
+	m.OnCooldown(1, time.Hour)
+	require.Contains(t, scrape(t, m), `clancy_step_outcomes_total{command="opencode",config="clancy",reason="retry"} 1`)
+
+	// A rate limited step is counted before the backoff.
+	m.OnStepStart(2)
+	m.OnStepEnd(loop.StepResult{Step: 2, ExitCode: 1}, false)
+	m.OnBackoff(2, 1, 1, time.Hour)
+	require.Contains(t, scrape(t, m), `clancy_step_outcomes_total{command="opencode",config="clancy",reason="retry"} 2`)
+
+	// Counted once, even when the run ends right after.
+	m.OnRunEnd(loop.RunSummary{})
+	require.Contains(t, scrape(t, m), `clancy_step_outcomes_total{command="opencode",config="clancy",reason="retry"} 2`)
+}
+
+// stepRunner runs fn as the agent and prints the stop phrase.
+type stepRunner func()
+
+func (fn stepRunner) Run(ctx context.Context, command string, env map[string]string, out io.Writer) (string, error) {
+	fn()
+	return "DONE", nil
+}
+
+func TestMetrics_Remaining(t *testing.T) {
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop:  config.LoopConfig{MaxSteps: 1, StopPhrase: "DONE", TimeoutDuration: time.Hour},
+	}
+	ctrl := loop.NewControl()
+	m := New("clancy.yaml", "cmd", ctrl)
+
+	var during float64
+	r := stepRunner(func() { during = m.remaining() })
+	require.NoError(t, loop.Run(context.Background(), cfg, r, "prompt", loop.WithControl(ctrl), loop.WithObservers(m)))
+	require.Greater(t, during, 3500.0)
+	require.LessOrEqual(t, during, 3600.0)
+
+	// The budget stops counting down when the run ends.
+	after := m.remaining()
+	require.LessOrEqual(t, after, during)
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, after, m.remaining())
+}
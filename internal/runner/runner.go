@@ -1,15 +1,197 @@
 package runner
 
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultGracePeriod is the time RealRunner waits after asking the agent to
+// terminate before killing it.
+const DefaultGracePeriod = 5 * time.Second
+
+// ErrIdleTimeout is returned by RealRunner when the agent was stopped because
+// it produced no output for longer than the idle timeout.
+var ErrIdleTimeout = errors.New("idle timeout")
+
 // AgentRunner defines the interface for executing agent commands.
 // This allows mocking the execution logic for testing.
+// Implementations must stop the command when ctx is cancelled. When out is
+// not nil, it receives the output as it is produced, e.g. to record it.
 type AgentRunner interface {
-	Run(command string, env map[string]string) (output string, err error)
+	Run(ctx context.Context, command string, env map[string]string, out io.Writer) (output string, err error)
 }
 
 // RealRunner implements AgentRunner using actual system processes.
-type RealRunner struct{}
+type RealRunner struct {
+	// GracePeriod is how long to wait between the graceful termination
+	// request and the forced kill once the context is cancelled.
+	GracePeriod time.Duration
+
+	// IdleTimeout stops the agent when it produces no output for this long.
+	// Zero disables the watchdog.
+	IdleTimeout time.Duration
+
+	// StopCheck, when set, is evaluated against the output captured so far
+	// while the agent is still running. Once it reports true and the stream
+	// has been quiet for StopQuiet, the agent is terminated gracefully and
+	// Run returns the output without error. Only supported on Unix.
+	StopCheck func(output string) bool
+	StopQuiet time.Duration
+
+	// Stdout receives the agent output for display. Nil means os.Stdout.
+	Stdout io.Writer
+
+	mu  sync.Mutex
+	pid int // PID of the running command, 0 when idle
+}
 
 // NewRealRunner creates a new instance of RealRunner.
 func NewRealRunner() *RealRunner {
-	return &RealRunner{}
+	return &RealRunner{GracePeriod: DefaultGracePeriod}
+}
+
+// watchers holds the settings of the watchers stopping a command early.
+type watchers struct {
+	idleTimeout time.Duration
+	stopCheck   func(output string) bool
+	stopQuiet   time.Duration
+}
+
+// Run executes command, stopping it early as set in IdleTimeout and
+// StopCheck.
+func (r *RealRunner) Run(ctx context.Context, command string, env map[string]string, out io.Writer) (string, error) {
+	return r.run(ctx, command, env, out, watchers{idleTimeout: r.IdleTimeout, stopCheck: r.StopCheck, stopQuiet: r.StopQuiet})
+}
+
+// Plain returns a runner sharing the output, grace period and signals of r,
+// but without the idle watchdog and the stop check. Commands that must run
+// to completion, like loop.verify, use it.
+func (r *RealRunner) Plain() AgentRunner {
+	return plainRunner{r: r}
+}
+
+type plainRunner struct {
+	r *RealRunner
+}
+
+func (p plainRunner) Run(ctx context.Context, command string, env map[string]string, out io.Writer) (string, error) {
+	return p.r.run(ctx, command, env, out, watchers{})
+}
+
+// stdout returns where the agent output is displayed.
+func (r *RealRunner) stdout() io.Writer {
+	if r.Stdout == nil {
+		return os.Stdout
+	}
+	return r.Stdout
+}
+
+// setPID records the PID of the running command so that Signal and Kill can
+// reach it. Pass 0 once it has exited.
+func (r *RealRunner) setPID(pid int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pid = pid
+}
+
+func (r *RealRunner) activePID() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pid
+}
+
+// supervise watches ctx while a process is running. When ctx is cancelled it
+// calls terminate and, if the process is still alive after the grace period,
+// kill. The returned function must be called once the process has exited.
+func supervise(ctx context.Context, grace time.Duration, terminate, kill func()) (stop func()) {
+	exited := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		select {
+		case <-exited:
+			return
+		case <-ctx.Done():
+		}
+
+		terminate()
+
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+
+		select {
+		case <-exited:
+		case <-timer.C:
+			kill()
+		}
+	}()
+
+	return func() {
+		close(exited)
+		<-finished
+	}
+}
+
+// bestEffort is an io.Writer ignoring the errors of w. The output of the
+// command must keep flowing when a display or a recording fails, or the
+// command blocks once the pipe fills up.
+type bestEffort struct {
+	w io.Writer
+}
+
+func (b bestEffort) Write(p []byte) (int, error) {
+	_, _ = b.w.Write(p)
+	return len(p), nil
+}
+
+// activityWriter is an io.Writer that only records when it was last written to.
+type activityWriter struct {
+	last atomic.Int64
+}
+
+func newActivityWriter() *activityWriter {
+	w := &activityWriter{}
+	w.touch()
+	return w
+}
+
+func (w *activityWriter) Write(p []byte) (int, error) {
+	w.touch()
+	return len(p), nil
+}
+
+func (w *activityWriter) touch() {
+	w.last.Store(time.Now().UnixNano())
+}
+
+func (w *activityWriter) idleFor() time.Duration {
+	return time.Since(time.Unix(0, w.last.Load()))
+}
+
+// watchIdle cancels ctx with ErrIdleTimeout once w has been idle for timeout.
+// It returns when ctx is done.
+func watchIdle(ctx context.Context, cancel context.CancelCauseFunc, w *activityWriter, timeout time.Duration) {
+	// Check often enough to keep the overshoot small.
+	interval := max(min(timeout/10, time.Second), time.Millisecond)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if w.idleFor() >= timeout {
+				cancel(ErrIdleTimeout)
+				return
+			}
+		}
+	}
 }
@@ -4,18 +4,45 @@ package runner
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/creack/pty"
 )
 
-// Run executes a shell command in a pseudo-terminal.
-// It streams output to os.Stdout and also returns the full captured output.
-func (r *RealRunner) Run(command string, env map[string]string) (string, error) {
+// streamCheckInterval is how often the captured output is scanned for the
+// stop phrase while the agent runs.
+const streamCheckInterval = 250 * time.Millisecond
+
+// errStopPhrase is the internal cancellation cause used when the stop check
+// matched while the agent was still running.
+var errStopPhrase = errors.New("stop phrase detected")
+
+// stopMatch is the cancellation cause of the stop phrase watcher. It keeps
+// the output the stop check matched, before the agent printed anything else
+// while shutting down.
+type stopMatch struct {
+	output string
+}
+
+func (m *stopMatch) Error() string { return errStopPhrase.Error() }
+func (m *stopMatch) Unwrap() error { return errStopPhrase }
+
+// run executes a shell command in a pseudo-terminal.
+// It streams output to r.Stdout and also returns the full captured output.
+// If ctx is cancelled or the idle timeout fires, the whole process group
+// receives SIGTERM and, after the grace period, SIGKILL. The same happens
+// when the stop check matches, but then the run is reported as successful
+// with the output the check matched.
+func (r *RealRunner) run(ctx context.Context, command string, env map[string]string, out io.Writer, w watchers) (string, error) {
 	// Create the command. We use "sh -c" to allow complex command strings.
 	cmd := exec.Command("sh", "-c", command)
 
@@ -28,24 +55,68 @@ func (r *RealRunner) Run(command string, env map[string]string) (string, error)
 	}
 	cmd.Env = newEnv
 
-	// Start with PTY
+	// runCtx is also cancelled by the idle and stop phrase watchers.
+	runCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// Start with PTY. The child becomes a session leader, so its PID is
+	// also the ID of the process group we signal on cancellation.
 	ptmx, err := pty.Start(cmd)
 	if err != nil {
 		return "", fmt.Errorf("failed to start pty: %w", err)
 	}
 	defer func() { _ = ptmx.Close() }() // Best effort close
 
-	// Capture output while streaming
-	var buf bytes.Buffer
+	pgid := cmd.Process.Pid
+	r.setPID(pgid)
+	defer r.setPID(0)
+
+	stop := supervise(runCtx, r.GracePeriod,
+		func() { _ = syscall.Kill(-pgid, syscall.SIGTERM) },
+		func() { _ = syscall.Kill(-pgid, syscall.SIGKILL) },
+	)
 
-	// MultiWriter to write to both Stdout and our buffer
-	mw := io.MultiWriter(os.Stdout, &buf)
+	// Capture output while streaming. The buffer is read concurrently by
+	// the stop phrase watcher.
+	var buf syncBuffer
+
+	// MultiWriter to write to Stdout, our buffer, the idle watchdog and out
+	activity := newActivityWriter()
+	writers := []io.Writer{bestEffort{r.stdout()}, &buf, activity}
+	if out != nil {
+		writers = append(writers, bestEffort{out})
+	}
+	mw := io.MultiWriter(writers...)
+	if w.idleTimeout > 0 {
+		go watchIdle(runCtx, cancel, activity, w.idleTimeout)
+	}
+	if w.stopCheck != nil {
+		go watchStopPhrase(runCtx, cancel, &buf, activity, w.stopCheck, w.stopQuiet)
+	}
 
 	// Copy content.
 	_, _ = io.Copy(mw, ptmx)
 
 	// Wait for the command to exit
 	err = cmd.Wait()
+	stop()
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return buf.String(), fmt.Errorf("agent terminated: %w", ctxErr)
+	}
+	switch cause := context.Cause(runCtx); {
+	case errors.Is(cause, ErrIdleTimeout):
+		return buf.String(), fmt.Errorf("agent terminated after %s without output: %w", w.idleTimeout, cause)
+	case errors.Is(cause, errStopPhrase):
+		// We stopped the agent on purpose, its exit status is irrelevant.
+		// What it printed while shutting down could defeat the stop check,
+		// e.g. in suffix mode, so it is left out.
+		var match *stopMatch
+		if errors.As(cause, &match) {
+			return match.output, nil
+		}
+		return buf.String(), nil
+	}
 	if err != nil {
 		return buf.String(), err
 	}
@@ -53,9 +124,92 @@ func (r *RealRunner) Run(command string, env map[string]string) (string, error)
 	return buf.String(), nil
 }
 
+// TerminalSize returns the size of the terminal Clancy runs in, or 80x24
+// when stdout is not a terminal.
+func TerminalSize() (cols, rows int) {
+	size, err := pty.GetsizeFull(os.Stdout)
+	if err != nil || size.Cols == 0 || size.Rows == 0 {
+		return 80, 24
+	}
+	return int(size.Cols), int(size.Rows)
+}
+
+// Signal forwards sig to the process group of the running command, if any.
+func (r *RealRunner) Signal(sig os.Signal) error {
+	pgid := r.activePID()
+	if pgid == 0 {
+		return nil
+	}
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal: %v", sig)
+	}
+	return syscall.Kill(-pgid, s)
+}
+
+// Kill immediately kills the process group of the running command, if any.
+func (r *RealRunner) Kill() error {
+	return r.Signal(syscall.SIGKILL)
+}
+
+// watchStopPhrase scans the captured output while the agent runs and cancels
+// ctx with errStopPhrase once check matches and the stream has been quiet for
+// quiet. With a zero quiet period it stops as soon as the phrase is seen.
+func watchStopPhrase(ctx context.Context, cancel context.CancelCauseFunc, buf *syncBuffer, activity *activityWriter, check func(string) bool, quiet time.Duration) {
+	ticker := time.NewTicker(streamCheckInterval)
+	defer ticker.Stop()
+
+	checkedLen := 0
+	matched := false
+	var output string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Only rescan when new output arrived since the last check.
+		if n := buf.Len(); n != checkedLen {
+			output = buf.String()
+			checkedLen = len(output)
+			matched = check(output)
+		}
+
+		if matched && activity.idleFor() >= quiet {
+			cancel(&stopMatch{output: output})
+			return
+		}
+	}
+}
+
 // PrepareCommand injects the prompt into the command template using Bash escaping.
 func PrepareCommand(tmpl string, prompt string) string {
 	// Escape single quotes: ' -> '"'"'
 	escapedPrompt := strings.ReplaceAll(prompt, "'", `'"'"'`)
 	return strings.ReplaceAll(tmpl, "${PROMPT}", escapedPrompt)
 }
+
+// syncBuffer is a bytes.Buffer safe for one writer and concurrent readers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -3,7 +3,13 @@
 package runner
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -46,16 +52,142 @@ func TestPrepareCommand(t *testing.T) {
 func TestRealRunner_Run_Echo(t *testing.T) {
 	// This test uses the real OS execution, assuming 'echo' exists.
 	r := NewRealRunner()
-	output, err := r.Run("echo 'hello from runner'", nil)
+	output, err := r.Run(context.Background(), "echo 'hello from runner'", nil, nil)
 	require.NoError(t, err)
 	require.Contains(t, output, "hello from runner")
 }
 
+func TestRealRunner_Run_Out(t *testing.T) {
+	r := NewRealRunner()
+	var out bytes.Buffer
+	output, err := r.Run(context.Background(), "echo 'streamed'", nil, &out)
+	require.NoError(t, err)
+	require.Equal(t, output, out.String())
+	require.Contains(t, out.String(), "streamed")
+}
+
 func TestRealRunner_Run_Env(t *testing.T) {
 	r := NewRealRunner()
 	env := map[string]string{"TEST_VAR": "custom_value"}
 	// We use 'env' command to print environment variables
-	output, err := r.Run("env", env)
+	output, err := r.Run(context.Background(), "env", env, nil)
 	require.NoError(t, err)
 	require.Contains(t, output, "TEST_VAR=custom_value")
 }
+
+func TestRealRunner_Run_ContextCancel(t *testing.T) {
+	r := NewRealRunner()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := r.Run(ctx, "sleep 10", nil, nil)
+	require.Error(t, err)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRealRunner_Run_KillAfterGracePeriod(t *testing.T) {
+	// The shell and its child ignore SIGTERM, so only SIGKILL can stop them.
+	r := NewRealRunner()
+	r.GracePeriod = 200 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := r.Run(ctx, "trap '' TERM; sleep 10; echo survived", nil, nil)
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRealRunner_Run_IdleTimeout(t *testing.T) {
+	r := NewRealRunner()
+	r.IdleTimeout = 200 * time.Millisecond
+
+	start := time.Now()
+	output, err := r.Run(context.Background(), "echo 'before stall'; sleep 10", nil, nil)
+	require.ErrorIs(t, err, ErrIdleTimeout)
+	require.Contains(t, output, "before stall")
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRealRunner_Run_IdleTimeout_ActiveOutput(t *testing.T) {
+	// Output keeps arriving more often than the idle timeout.
+	r := NewRealRunner()
+	r.IdleTimeout = 500 * time.Millisecond
+
+	output, err := r.Run(context.Background(), "for i in 1 2 3 4; do echo tick; sleep 0.2; done", nil, nil)
+	require.NoError(t, err)
+	require.Contains(t, output, "tick")
+}
+
+func TestRealRunner_Run_StopCheck(t *testing.T) {
+	// The agent prints the phrase and keeps running; it must be stopped early.
+	r := NewRealRunner()
+	r.StopCheck = func(output string) bool { return strings.Contains(output, "DONE") }
+
+	start := time.Now()
+	output, err := r.Run(context.Background(), "echo 'work DONE'; sleep 10", nil, nil)
+	require.NoError(t, err)
+	require.Contains(t, output, "work DONE")
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRealRunner_Run_StopCheck_WaitsForQuiet(t *testing.T) {
+	// The phrase stops matching once more output arrives, so the quiet period
+	// must not have elapsed before the agent finishes on its own.
+	r := NewRealRunner()
+	r.StopCheck = func(output string) bool {
+		return strings.HasSuffix(strings.TrimSpace(output), "DONE")
+	}
+	r.StopQuiet = time.Second
+
+	output, err := r.Run(context.Background(), "echo DONE; sleep 0.3; echo 'more'; exit 3", nil, nil)
+	require.Error(t, err)
+	require.Contains(t, output, "more")
+}
+
+// failingWriter fails every write, like a recording on a full disk.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestRealRunner_Run_FailingOutput(t *testing.T) {
+	// The output is still drained, so the command is not blocked.
+	r := NewRealRunner()
+	r.Stdout = failingWriter{}
+
+	output, err := r.Run(context.Background(), "head -c 200000 /dev/zero | tr '\\0' x; echo end", nil, failingWriter{})
+	require.NoError(t, err)
+	require.Contains(t, output, "end")
+}
+
+func TestRealRunner_Plain(t *testing.T) {
+	// A verifier printing the stop phrase and staying quiet runs to the end.
+	r := NewRealRunner()
+	r.IdleTimeout = 200 * time.Millisecond
+	r.StopCheck = func(output string) bool { return strings.Contains(output, "DONE") }
+
+	output, err := r.Plain().Run(context.Background(), "echo DONE; sleep 0.5; echo failed; exit 1", nil, nil)
+	require.Error(t, err)
+	require.Contains(t, output, "failed")
+}
+
+func TestRealRunner_Signal(t *testing.T) {
+	r := NewRealRunner()
+	require.NoError(t, r.Signal(os.Interrupt)) // Nothing running, no-op
+
+	go func() {
+		// Give the shell time to install its trap.
+		time.Sleep(300 * time.Millisecond)
+		_ = r.Signal(os.Interrupt)
+	}()
+
+	start := time.Now()
+	output, err := r.Run(context.Background(), "trap 'echo got-sigint; exit 0' INT; sleep 10 & wait", nil, nil)
+	require.NoError(t, err)
+	require.Contains(t, output, "got-sigint")
+	require.Less(t, time.Since(start), 5*time.Second)
+}
@@ -4,16 +4,22 @@ package runner
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 )
 
-// Run executes a command using cmd.exe on Windows.
+// run executes a command using cmd.exe on Windows.
 // Note: PTY support is limited/absent here, so we use standard pipes.
-func (r *RealRunner) Run(command string, env map[string]string) (string, error) {
+// If ctx is cancelled or the idle timeout fires, the process tree is asked to close and, after the
+// grace period, forcefully terminated.
+func (r *RealRunner) run(ctx context.Context, command string, env map[string]string, out io.Writer, w watchers) (string, error) {
 	// Use cmd /C to execute the command string
 	cmd := exec.Command("cmd", "/C", command)
 
@@ -26,15 +32,53 @@ func (r *RealRunner) Run(command string, env map[string]string) (string, error)
 	}
 	cmd.Env = newEnv
 
+	// runCtx is also cancelled by the idle watchdog.
+	runCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
 	// Capture output
 	var buf bytes.Buffer
+	activity := newActivityWriter()
 
-	// Stream to stdout/stderr
-	cmd.Stdout = io.MultiWriter(os.Stdout, &buf)
-	cmd.Stderr = io.MultiWriter(os.Stderr, &buf)
+	// Stream to stdout/stderr, and to out if given
+	stdout := []io.Writer{bestEffort{r.stdout()}, &buf, activity}
+	stderr := []io.Writer{bestEffort{os.Stderr}, &buf, activity}
+	if out != nil {
+		stdout, stderr = append(stdout, bestEffort{out}), append(stderr, bestEffort{out})
+	}
+	cmd.Stdout = io.MultiWriter(stdout...)
+	cmd.Stderr = io.MultiWriter(stderr...)
 	cmd.Stdin = os.Stdin
 
-	err := cmd.Run()
+	// Do not hang on pipes kept open by orphaned grandchildren.
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	r.setPID(cmd.Process.Pid)
+	defer r.setPID(0)
+
+	pid := strconv.Itoa(cmd.Process.Pid)
+	if w.idleTimeout > 0 {
+		go watchIdle(runCtx, cancel, activity, w.idleTimeout)
+	}
+
+	stop := supervise(runCtx, r.GracePeriod,
+		func() { _ = exec.Command("taskkill", "/T", "/PID", pid).Run() },
+		func() { _ = exec.Command("taskkill", "/T", "/F", "/PID", pid).Run() },
+	)
+
+	err := cmd.Wait()
+	stop()
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return buf.String(), fmt.Errorf("agent terminated: %w", ctxErr)
+	}
+	if cause := context.Cause(runCtx); errors.Is(cause, ErrIdleTimeout) {
+		return buf.String(), fmt.Errorf("agent terminated after %s without output: %w", w.idleTimeout, cause)
+	}
 	if err != nil {
 		return buf.String(), err
 	}
@@ -42,6 +86,31 @@ func (r *RealRunner) Run(command string, env map[string]string) (string, error)
 	return buf.String(), nil
 }
 
+// TerminalSize returns the default 80x24, the console size is not queried
+// on Windows.
+func TerminalSize() (cols, rows int) {
+	return 80, 24
+}
+
+// Signal asks the process tree of the running command, if any, to close.
+// Windows has no POSIX signals, so sig only documents the intent.
+func (r *RealRunner) Signal(sig os.Signal) error {
+	pid := r.activePID()
+	if pid == 0 {
+		return nil
+	}
+	return exec.Command("taskkill", "/T", "/PID", strconv.Itoa(pid)).Run()
+}
+
+// Kill forcefully terminates the process tree of the running command, if any.
+func (r *RealRunner) Kill() error {
+	pid := r.activePID()
+	if pid == 0 {
+		return nil
+	}
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(pid)).Run()
+}
+
 // PrepareCommand injects the prompt into the command template using Windows escaping logic.
 // It assumes the user wraps ${PROMPT} in double quotes in the config for Windows.
 func PrepareCommand(tmpl string, prompt string) string {
@@ -0,0 +1,36 @@
+//go:build windows
+
+package runner
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRealRunner_Signal(t *testing.T) {
+	r := NewRealRunner()
+	r.Stdout = io.Discard
+	require.NoError(t, r.Signal(os.Interrupt)) // Nothing running, no-op
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.Run(context.Background(), "ping -n 30 127.0.0.1", nil, nil)
+		done <- err
+	}()
+
+	require.Eventually(t, func() bool { return r.activePID() != 0 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, r.Kill())
+
+	select {
+	case err := <-done:
+		require.Error(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("agent was not killed")
+	}
+	require.Zero(t, r.activePID())
+}
@@ -0,0 +1,129 @@
+package runs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/eduardolat/clancy/internal/ansi"
+	"github.com/eduardolat/clancy/internal/asciicast"
+)
+
+// StepMeta describes a single agent invocation, stored next to its
+// transcript as step-NN.meta.json.
+type StepMeta struct {
+	Step        int       `json:"step"`
+	Attempt     int       `json:"attempt"`
+	Status      string    `json:"status"`
+	ExitCode    int       `json:"exit_code"`
+	Error       string    `json:"error,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	EndedAt     time.Time `json:"ended_at"`
+	Duration    Duration  `json:"duration"`
+	StopMatched bool      `json:"stop_matched"` // Whether the stop condition was met
+}
+
+// StepName returns the base name of the artifacts of a step, e.g. "step-03".
+// Repeated attempts of the same step get a suffix ("step-03-2"), so earlier
+// transcripts are never overwritten.
+func StepName(step, attempt int) string {
+	if attempt > 1 {
+		return fmt.Sprintf("step-%02d-%d", step, attempt)
+	}
+	return fmt.Sprintf("step-%02d", step)
+}
+
+// Attempts returns how many times step has been recorded in the run.
+func (r *Run) Attempts(step int) int {
+	n := 0
+	for _, rec := range r.State.Steps {
+		if rec.Step == step {
+			n++
+		}
+	}
+	return n
+}
+
+// Recording is an asciicast recording of a step being written to disk.
+type Recording struct {
+	*asciicast.Writer
+	file *os.File
+}
+
+// Close finishes the recording.
+func (rec *Recording) Close() error {
+	return rec.file.Close()
+}
+
+// Record starts the recording of a step attempt as step-NN.cast, for a
+// terminal of the given size.
+func (r *Run) Record(step, attempt, width, height int) (*Recording, error) {
+	name := StepName(step, attempt)
+	f, err := os.Create(filepath.Join(r.Dir, name+".cast"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+	w, err := asciicast.NewWriter(f, width, height, fmt.Sprintf("Clancy %s %s", r.State.ID, name))
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to write recording: %w", err)
+	}
+	return &Recording{Writer: w, file: f}, nil
+}
+
+// Recordings returns the paths of the recordings of step, or of every step
+// when step is 0, in the order they were run.
+func (r *Run) Recordings(step int) []string {
+	var paths []string
+	attempts := map[int]int{}
+	for _, rec := range r.State.Steps {
+		attempts[rec.Step]++
+		if step != 0 && rec.Step != step {
+			continue
+		}
+		path := filepath.Join(r.Dir, StepName(rec.Step, attempts[rec.Step])+".cast")
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// WriteStep stores the transcript of a step in the run directory: the raw
+// terminal output (.log), the same output without ANSI escapes (.txt), the
+// exact command executed (.cmd) and meta.
+func (r *Run) WriteStep(command, output string, meta StepMeta) error {
+	base := filepath.Join(r.Dir, StepName(meta.Step, meta.Attempt))
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode step metadata: %w", err)
+	}
+
+	files := []struct {
+		ext  string
+		data []byte
+	}{
+		{".log", []byte(output)},
+		{".txt", []byte(ansi.Strip(output))},
+		{".cmd", []byte(command + "\n")},
+		{".meta.json", data},
+	}
+	for _, f := range files {
+		if err := os.WriteFile(base+f.ext, f.data, 0644); err != nil {
+			return fmt.Errorf("failed to write step artifacts: %w", err)
+		}
+	}
+	return nil
+}
+
+// WriteProgress stores a snapshot of the progress file after a step.
+func (r *Run) WriteProgress(step, attempt int, data []byte) error {
+	path := filepath.Join(r.Dir, StepName(step, attempt)+".progress.md")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to snapshot the progress file: %w", err)
+	}
+	return nil
+}
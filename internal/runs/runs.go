@@ -0,0 +1,168 @@
+// Package runs persists the state of Clancy runs on disk, so an interrupted
+// run can be resumed later. Every run lives in its own directory:
+// <base>/<run-id>/state.json.
+package runs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	gonanoid "github.com/matoous/go-nanoid/v2"
+)
+
+// DefaultDir is where runs are stored, relative to the working directory.
+const DefaultDir = ".clancy/runs"
+
+// stateFile is the name of the state file inside a run directory.
+const stateFile = "state.json"
+
+// Run statuses.
+const (
+	StatusRunning     = "running"
+	StatusSucceeded   = "succeeded"
+	StatusFailed      = "failed"
+	StatusInterrupted = "interrupted"
+)
+
+// Duration is a time.Duration that is stored as a readable string ("1m30s").
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// StepRecord is the persisted outcome of a single step.
+type StepRecord struct {
+	Step      int       `json:"step"`
+	Status    string    `json:"status"`
+	ExitCode  int       `json:"exit_code"`
+	Error     string    `json:"error,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	Duration  Duration  `json:"duration"`
+}
+
+// State is everything needed to resume a run.
+type State struct {
+	ID         string `json:"id"`
+	ConfigPath string `json:"config_path"`
+	ConfigHash string `json:"config_hash"`
+	PromptHash string `json:"prompt_hash"`
+	// SettingsHash covers the config without what input.reload reads again,
+	// the prompt, agent.command and agent.env. Empty in older runs.
+	SettingsHash string       `json:"settings_hash,omitempty"`
+	Status       string       `json:"status"`
+	NextStep     int          `json:"next_step"` // Step to run when resuming
+	Elapsed      Duration     `json:"elapsed"`   // Time spent so far, across resumes, frozen pauses excluded
+	CreatedAt    time.Time    `json:"created_at"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+	Steps        []StepRecord `json:"steps"`
+}
+
+// Run is a run directory together with its state.
+type Run struct {
+	Dir   string
+	State State
+}
+
+// NewID generates a run ID that sorts by creation time, e.g.
+// "20250601-143000-x7k2p9".
+func NewID() (string, error) {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	suffix, err := gonanoid.Generate(alphabet, 6)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate run ID: %w", err)
+	}
+	return time.Now().Format("20060102-150405") + "-" + suffix, nil
+}
+
+// Hash returns a hex encoded SHA-256 of data, used to detect changes to the
+// config and prompt between resumes.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Create makes a new run directory under base and writes its initial state.
+func Create(base string, state State) (*Run, error) {
+	if state.ID == "" {
+		id, err := NewID()
+		if err != nil {
+			return nil, err
+		}
+		state.ID = id
+	}
+	if state.Status == "" {
+		state.Status = StatusRunning
+	}
+	if state.NextStep == 0 {
+		state.NextStep = 1
+	}
+	if state.CreatedAt.IsZero() {
+		state.CreatedAt = time.Now()
+	}
+
+	run := &Run{Dir: filepath.Join(base, state.ID), State: state}
+	if err := os.MkdirAll(run.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create run directory: %w", err)
+	}
+	if err := run.Save(); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// Open loads an existing run from base.
+func Open(base, id string) (*Run, error) {
+	dir := filepath.Join(base, id)
+	data, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("run %q not found in %s", id, base)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run state: %w", err)
+	}
+
+	run := &Run{Dir: dir}
+	if err := json.Unmarshal(data, &run.State); err != nil {
+		return nil, fmt.Errorf("failed to parse run state: %w", err)
+	}
+	return run, nil
+}
+
+// Save writes the state to disk atomically, so a crash never leaves a
+// truncated state file behind.
+func (r *Run) Save() error {
+	r.State.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(r.State, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode run state: %w", err)
+	}
+
+	tmp := filepath.Join(r.Dir, stateFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write run state: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(r.Dir, stateFile)); err != nil {
+		return fmt.Errorf("failed to write run state: %w", err)
+	}
+	return nil
+}
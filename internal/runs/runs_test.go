@@ -0,0 +1,97 @@
+package runs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateAndOpen(t *testing.T) {
+	base := t.TempDir()
+
+	run, err := Create(base, State{ConfigPath: "clancy.yaml", ConfigHash: Hash([]byte("cfg"))})
+	require.NoError(t, err)
+	require.NotEmpty(t, run.State.ID)
+	require.Equal(t, filepath.Join(base, run.State.ID), run.Dir)
+	require.Equal(t, StatusRunning, run.State.Status)
+	require.Equal(t, 1, run.State.NextStep)
+
+	run.State.NextStep = 4
+	run.State.Elapsed = Duration(90 * time.Second)
+	run.State.Steps = append(run.State.Steps, StepRecord{Step: 3, Status: "completed", ExitCode: 2, Error: "exit status 2"})
+	require.NoError(t, run.Save())
+
+	opened, err := Open(base, run.State.ID)
+	require.NoError(t, err)
+	require.Equal(t, "clancy.yaml", opened.State.ConfigPath)
+	require.Equal(t, run.State.ConfigHash, opened.State.ConfigHash)
+	require.Equal(t, 4, opened.State.NextStep)
+	require.Equal(t, Duration(90*time.Second), opened.State.Elapsed)
+	require.Len(t, opened.State.Steps, 1)
+	require.Equal(t, 2, opened.State.Steps[0].ExitCode)
+	require.Equal(t, "exit status 2", opened.State.Steps[0].Error)
+}
+
+func TestOpen_NotFound(t *testing.T) {
+	_, err := Open(t.TempDir(), "missing")
+	require.ErrorContains(t, err, `run "missing" not found`)
+}
+
+func TestHash(t *testing.T) {
+	require.Equal(t, Hash([]byte("a")), Hash([]byte("a")))
+	require.NotEqual(t, Hash([]byte("a")), Hash([]byte("b")))
+}
+
+func TestWriteStep(t *testing.T) {
+	run, err := Create(t.TempDir(), State{})
+	require.NoError(t, err)
+
+	started := time.Now()
+	meta := StepMeta{Step: 3, Attempt: 1, Status: "completed", StartedAt: started, EndedAt: started.Add(time.Second), StopMatched: true}
+	require.NoError(t, run.WriteStep("echo hi", "\x1b[32mhi\x1b[0m\r\n", meta))
+	meta.Attempt = 2
+	require.NoError(t, run.WriteStep("echo hi", "again\r\n", meta))
+
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(run.Dir, name))
+		require.NoError(t, err)
+		return string(data)
+	}
+	require.Equal(t, "\x1b[32mhi\x1b[0m\r\n", read("step-03.log"))
+	require.Equal(t, "hi\n", read("step-03.txt"))
+	require.Equal(t, "echo hi\n", read("step-03.cmd"))
+	require.Contains(t, read("step-03.meta.json"), `"stop_matched": true`)
+	require.Equal(t, "again\n", read("step-03-2.txt"))
+}
+
+func TestRecordings(t *testing.T) {
+	run, err := Create(t.TempDir(), State{})
+	require.NoError(t, err)
+
+	record := func(step, attempt int) {
+		rec, err := run.Record(step, attempt, 80, 24)
+		require.NoError(t, err)
+		_, err = rec.Write([]byte("output"))
+		require.NoError(t, err)
+		require.NoError(t, rec.Close())
+		run.State.Steps = append(run.State.Steps, StepRecord{Step: step})
+	}
+	record(1, 1)
+	record(2, 1)
+	record(2, 2)
+	run.State.Steps = append(run.State.Steps, StepRecord{Step: 3}) // Not recorded
+
+	base := func(paths []string) []string {
+		names := make([]string, len(paths))
+		for i, p := range paths {
+			names[i] = filepath.Base(p)
+		}
+		return names
+	}
+	require.Equal(t, []string{"step-01.cast", "step-02.cast", "step-02-2.cast"}, base(run.Recordings(0)))
+	require.Equal(t, []string{"step-02.cast", "step-02-2.cast"}, base(run.Recordings(2)))
+	require.Empty(t, run.Recordings(3))
+}
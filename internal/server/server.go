@@ -0,0 +1,383 @@
+// Package server implements the optional HTTP API enabled with --listen, to
+// check on a run and control it from elsewhere.
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eduardolat/clancy/internal/ansi"
+	"github.com/eduardolat/clancy/internal/events"
+	"github.com/eduardolat/clancy/internal/loop"
+	"github.com/eduardolat/clancy/internal/runs"
+)
+
+const (
+	// maxLive caps the output of the current step kept in memory.
+	maxLive = 1024 * 1024
+
+	// subscriberBuffer is how many events a slow /events client may fall
+	// behind before events are dropped for it.
+	subscriberBuffer = 256
+)
+
+// Run states reported by /status.
+const (
+	StateStarting = "starting"
+	StateRunning  = "running"
+	StatePaused   = "paused"
+	StateWaiting  = "waiting" // Delay or backoff between steps
+	StateFinished = "finished"
+)
+
+// Options configures the server.
+type Options struct {
+	Control *loop.Control
+	Abort   func()       // Ends the loop after the current step
+	Run     *runs.Run    // Source of the transcripts of earlier steps
+	Token   string       // Required as a bearer token when not empty
+	Metrics http.Handler // Served on /metrics when not nil
+}
+
+// Status is the body of GET /status. Durations are in milliseconds.
+type Status struct {
+	RunID       string      `json:"run_id,omitempty"`
+	State       string      `json:"state"`
+	Step        int         `json:"step"`
+	MaxSteps    int         `json:"max_steps"`
+	ElapsedMS   int64       `json:"elapsed_ms"`
+	TimeoutMS   int64       `json:"timeout_ms,omitempty"`
+	LastResult  *StepResult `json:"last_result,omitempty"`
+	Reason      string      `json:"reason,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	StopPending bool        `json:"stop_pending"`
+}
+
+// StepResult describes the last finished step in a Status.
+type StepResult struct {
+	Step        int    `json:"step"`
+	Status      string `json:"status"`
+	ExitCode    int    `json:"exit_code"`
+	DurationMS  int64  `json:"duration_ms"`
+	StopMatched bool   `json:"stop_matched"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Server is a loop.Observer serving the progress of the run it observes. The
+// /events stream carries the same events as --events json.
+type Server struct {
+	*events.Writer
+
+	opts Options
+
+	mu       sync.Mutex
+	status   Status
+	live     bytes.Buffer // Output of the current step
+	attempts map[int]int
+	subs     map[chan []byte]struct{}
+}
+
+var _ loop.Observer = (*Server)(nil)
+
+// New creates a server. Pass it to loop.WithObservers and serve Handler.
+func New(opts Options) *Server {
+	s := &Server{
+		opts:     opts,
+		status:   Status{State: StateStarting},
+		attempts: map[int]int{},
+		subs:     map[chan []byte]struct{}{},
+	}
+	s.Writer = events.NewWriter(broadcaster{s})
+
+	// Later attempts of a step must not hide the transcript of the first
+	// ones when a run is resumed.
+	if opts.Run != nil {
+		for _, rec := range opts.Run.State.Steps {
+			s.attempts[rec.Step]++
+		}
+	}
+	return s
+}
+
+// Handler returns the HTTP handler of the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", s.handleStatus)
+	mux.HandleFunc("GET /steps/{step}/output", s.handleOutput)
+	mux.HandleFunc("GET /events", s.handleEvents)
+	mux.HandleFunc("POST /pause", s.handleControl(func() error { s.opts.Control.Pause(); return nil }))
+	mux.HandleFunc("POST /resume", s.handleControl(func() error { s.opts.Control.Resume(); return nil }))
+	mux.HandleFunc("POST /abort", s.handleControl(func() error { s.opts.Abort(); return nil }))
+	mux.HandleFunc("POST /skip-delay", s.handleControl(func() error {
+		if !s.opts.Control.SkipDelay() {
+			return errNoDelay
+		}
+		return nil
+	}))
+	if s.opts.Metrics != nil {
+		mux.Handle("GET /metrics", s.opts.Metrics)
+	}
+	return s.authorize(mux)
+}
+
+var errNoDelay = errors.New("no delay in progress")
+
+// authorize requires the bearer token, if any, on every request.
+func (s *Server) authorize(next http.Handler) http.Handler {
+	if s.opts.Token == "" {
+		return next
+	}
+	want := []byte("Bearer " + s.opts.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="clancy"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	status := s.status
+	// The loop clock covers previous sessions of a resumed run and leaves
+	// out frozen pauses. The timeout is then the whole budget of the run.
+	if elapsed, ok := s.opts.Control.Elapsed(); ok {
+		status.ElapsedMS = elapsed.Milliseconds()
+	}
+	if timeout, ok := s.opts.Control.Timeout(); ok {
+		status.TimeoutMS = timeout.Milliseconds()
+	}
+	if status.State != StateFinished {
+		select {
+		case <-s.opts.Control.Stopping():
+			status.StopPending = true
+		default:
+		}
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// handleOutput serves the output of a step without ANSI escape codes: the
+// live output for the current step, the transcript of its last attempt
+// otherwise.
+func (s *Server) handleOutput(w http.ResponseWriter, r *http.Request) {
+	step, err := strconv.Atoi(r.PathValue("step"))
+	if err != nil || step < 1 {
+		http.Error(w, "invalid step", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	current := step == s.status.Step && s.status.State == StateRunning
+	live := s.live.String()
+	attempts := s.attempts[step]
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if current {
+		_, _ = fmt.Fprint(w, ansi.Strip(live))
+		return
+	}
+	if s.opts.Run == nil || attempts == 0 {
+		http.Error(w, "step not found", http.StatusNotFound)
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(s.opts.Run.Dir, runs.StepName(step, attempts)+".txt"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot read the transcript: %v", err), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(data)
+}
+
+// handleEvents streams the events of the run as server-sent events, until
+// the client disconnects or the run ends.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := make(chan []byte, subscriberBuffer)
+	s.mu.Lock()
+	finished := s.status.State == StateFinished
+	if !finished {
+		s.subs[ch] = struct{}{}
+	}
+	s.mu.Unlock()
+	if finished {
+		http.Error(w, "the run has finished", http.StatusGone)
+		return
+	}
+	defer s.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case line, ok := <-ch:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", line); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *Server) unsubscribe(ch chan []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[ch]; ok {
+		delete(s.subs, ch)
+		close(ch)
+	}
+}
+
+// handleControl runs action for a POST request.
+func (s *Server) handleControl(action func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := action(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// broadcaster sends every event encoded by the events.Writer to the /events
+// subscribers.
+type broadcaster struct {
+	s *Server
+}
+
+func (b broadcaster) Write(p []byte) (int, error) {
+	line := bytes.TrimRight(p, "\n")
+	line = append([]byte(nil), line...)
+
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+	for ch := range b.s.subs {
+		select {
+		case ch <- line:
+		default: // Too slow, drop the event rather than block the loop
+		}
+	}
+	return len(p), nil
+}
+
+func (s *Server) setState(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.State = state
+}
+
+func (s *Server) OnRunStart(info loop.RunInfo) {
+	s.mu.Lock()
+	s.status.RunID = info.RunID
+	s.status.Step = info.FirstStep
+	s.status.MaxSteps = info.MaxSteps
+	s.status.TimeoutMS = info.Timeout.Milliseconds()
+	s.status.State = StateRunning
+	s.mu.Unlock()
+	s.Writer.OnRunStart(info)
+}
+
+func (s *Server) OnStepStart(step int) {
+	s.mu.Lock()
+	s.status.Step = step
+	s.status.State = StateRunning
+	s.live.Reset()
+	s.mu.Unlock()
+	s.Writer.OnStepStart(step)
+}
+
+func (s *Server) OnStepOutput(step int, data []byte) {
+	s.mu.Lock()
+	if s.live.Len()+len(data) > maxLive {
+		// Keep the most recent half.
+		keep := append([]byte(nil), s.live.Bytes()[s.live.Len()-maxLive/2:]...)
+		s.live.Reset()
+		s.live.Write(keep)
+	}
+	s.live.Write(data)
+	s.mu.Unlock()
+	s.Writer.OnStepOutput(step, data)
+}
+
+func (s *Server) OnStepEnd(res loop.StepResult, stopMatched bool) {
+	last := &StepResult{
+		Step:        res.Step,
+		Status:      string(res.Status),
+		ExitCode:    res.ExitCode,
+		DurationMS:  res.Duration.Milliseconds(),
+		StopMatched: stopMatched,
+	}
+	if res.Err != nil {
+		last.Error = res.Err.Error()
+	}
+
+	s.mu.Lock()
+	s.status.LastResult = last
+	s.attempts[res.Step]++
+	s.mu.Unlock()
+	s.Writer.OnStepEnd(res, stopMatched)
+}
+
+func (s *Server) OnCooldown(step int, delay time.Duration) {
+	s.setState(StateWaiting)
+	s.Writer.OnCooldown(step, delay)
+}
+
+func (s *Server) OnBackoff(step, rule, attempt int, delay time.Duration) {
+	s.setState(StateWaiting)
+	s.Writer.OnBackoff(step, rule, attempt, delay)
+}
+
+func (s *Server) OnPause(step int, frozen bool) {
+	s.setState(StatePaused)
+}
+
+func (s *Server) OnResume(step int) {
+	s.setState(StateRunning)
+}
+
+func (s *Server) OnRunEnd(summary loop.RunSummary) {
+	s.Writer.OnRunEnd(summary)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.State = StateFinished
+	s.status.Reason = summary.Reason
+	if summary.Err != nil {
+		s.status.Error = summary.Err.Error()
+	}
+	// End the /events streams, run_finished was the last event.
+	for ch := range s.subs {
+		delete(s.subs, ch)
+		close(ch)
+	}
+}
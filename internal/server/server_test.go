@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eduardolat/clancy/internal/config"
+	"github.com/eduardolat/clancy/internal/loop"
+	"github.com/eduardolat/clancy/internal/runs"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T, token string) (*Server, *loop.Control, *httptest.Server, *int) {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "step-01.txt"), []byte("first step\n"), 0644))
+
+	ctrl := loop.NewControl()
+	aborted := 0
+	s := New(Options{Control: ctrl, Abort: func() { aborted++ }, Run: &runs.Run{Dir: dir}, Token: token})
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return s, ctrl, ts, &aborted
+}
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	res, err := http.Get(url)
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res.StatusCode, string(body)
+}
+
+func post(t *testing.T, url string) int {
+	t.Helper()
+	res, err := http.Post(url, "", nil)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	return res.StatusCode
+}
+
+func TestServer_Status(t *testing.T) {
+	s, _, ts, _ := newTestServer(t, "")
+
+	s.OnRunStart(loop.RunInfo{RunID: "run-1", FirstStep: 1, MaxSteps: 5, Timeout: time.Hour})
+	s.OnStepStart(1)
+	s.OnStepOutput(1, []byte("\x1b[32mfirst\x1b[0m step\n"))
+	s.OnStepEnd(loop.StepResult{Step: 1, Status: loop.StepCompleted, ExitCode: 2, Duration: time.Second}, false)
+	s.OnStepStart(2)
+	s.OnStepOutput(2, []byte("\x1b[1mworking\x1b[0m"))
+
+	code, body := get(t, ts.URL+"/status")
+	require.Equal(t, http.StatusOK, code)
+	var status Status
+	require.NoError(t, json.Unmarshal([]byte(body), &status))
+	require.Equal(t, "run-1", status.RunID)
+	require.Equal(t, StateRunning, status.State)
+	require.Equal(t, 2, status.Step)
+	require.EqualValues(t, 3600000, status.TimeoutMS)
+	require.NotNil(t, status.LastResult)
+	require.Equal(t, 2, status.LastResult.ExitCode)
+
+	// The current step is served live, earlier ones from their transcript.
+	code, body = get(t, ts.URL+"/steps/2/output")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "working", body)
+	_, body = get(t, ts.URL+"/steps/1/output")
+	require.Equal(t, "first step\n", body)
+	code, _ = get(t, ts.URL+"/steps/9/output")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = get(t, ts.URL+"/steps/x/output")
+	require.Equal(t, http.StatusBadRequest, code)
+
+	s.OnRunEnd(loop.RunSummary{Reason: loop.ReasonSuccess})
+	_, body = get(t, ts.URL+"/status")
+	require.NoError(t, json.Unmarshal([]byte(body), &status))
+	require.Equal(t, StateFinished, status.State)
+	require.Equal(t, loop.ReasonSuccess, status.Reason)
+}
+
+func TestServer_Control(t *testing.T) {
+	_, ctrl, ts, aborted := newTestServer(t, "")
+
+	require.Equal(t, http.StatusNoContent, post(t, ts.URL+"/pause"))
+	require.True(t, ctrl.Paused())
+	require.Equal(t, http.StatusNoContent, post(t, ts.URL+"/resume"))
+	require.False(t, ctrl.Paused())
+	require.Equal(t, http.StatusNoContent, post(t, ts.URL+"/abort"))
+	require.Equal(t, 1, *aborted)
+
+	// Nothing to skip while no delay is running.
+	require.Equal(t, http.StatusConflict, post(t, ts.URL+"/skip-delay"))
+
+	code, _ := get(t, ts.URL+"/pause")
+	require.Equal(t, http.StatusMethodNotAllowed, code)
+}
+
+func TestServer_Token(t *testing.T) {
+	_, _, ts, _ := newTestServer(t, "secret")
+
+	code, _ := get(t, ts.URL+"/status")
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/status", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestServer_Events(t *testing.T) {
+	s, _, ts, _ := newTestServer(t, "")
+
+	res, err := http.Get(ts.URL + "/events")
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	s.OnStepStart(1)
+	s.OnStepOutput(1, []byte("hello\n"))
+	s.OnRunEnd(loop.RunSummary{Reason: loop.ReasonSuccess})
+
+	// The stream ends with the run.
+	var types []string
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var e map[string]any
+		require.NoError(t, json.Unmarshal([]byte(data), &e))
+		types = append(types, e["type"].(string))
+	}
+	require.Equal(t, []string{"step_started", "step_output_chunk", "run_finished"}, types)
+
+	code, _ := get(t, ts.URL+"/events")
+	require.Equal(t, http.StatusGone, code)
+}
+
+func TestServer_Metrics(t *testing.T) {
+	_, _, ts, _ := newTestServer(t, "")
+	code, _ := get(t, ts.URL+"/metrics")
+	require.Equal(t, http.StatusNotFound, code)
+
+	s := New(Options{Control: loop.NewControl(), Metrics: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "clancy_steps_total 1\n")
+	})})
+	ts2 := httptest.NewServer(s.Handler())
+	defer ts2.Close()
+	_, body := get(t, ts2.URL+"/metrics")
+	require.Equal(t, "clancy_steps_total 1\n", body)
+}
+
+// statusRunner fetches /status while the agent runs and prints the stop
+// phrase.
+type statusRunner struct {
+	t      *testing.T
+	url    string
+	status Status
+}
+
+func (r *statusRunner) Run(ctx context.Context, command string, env map[string]string, out io.Writer) (string, error) {
+	_, body := get(r.t, r.url+"/status")
+	require.NoError(r.t, json.Unmarshal([]byte(body), &r.status))
+	return "DONE", nil
+}
+
+func TestServer_Status_Resumed(t *testing.T) {
+	// The elapsed time of a resumed run includes its previous sessions.
+	run, err := runs.Create(t.TempDir(), runs.State{NextStep: 2, Elapsed: runs.Duration(10 * time.Minute)})
+	require.NoError(t, err)
+	cfg := &config.Config{
+		Agent: config.AgentConfig{Command: "cmd"},
+		Loop:  config.LoopConfig{MaxSteps: 3, StopPhrase: "DONE", TimeoutDuration: time.Hour},
+	}
+	ctrl := loop.NewControl()
+	s := New(Options{Control: ctrl, Run: run})
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	r := &statusRunner{t: t, url: ts.URL}
+	require.NoError(t, loop.Run(context.Background(), cfg, r, "p", loop.WithRun(run), loop.WithControl(ctrl), loop.WithObservers(s)))
+	require.GreaterOrEqual(t, r.status.ElapsedMS, (10 * time.Minute).Milliseconds())
+	require.Less(t, r.status.ElapsedMS, (11 * time.Minute).Milliseconds())
+	require.EqualValues(t, time.Hour.Milliseconds(), r.status.TimeoutMS)
+}
@@ -0,0 +1,298 @@
+// Package telemetry exports runs as OpenTelemetry traces: the run is the root
+// span, every iteration of the loop a child span.
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/eduardolat/clancy/internal/config"
+	"github.com/eduardolat/clancy/internal/loop"
+	"github.com/eduardolat/clancy/internal/version"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultFile is the name of the trace file written in the run directory
+// when no collector endpoint is set.
+const DefaultFile = "trace.json"
+
+// Tracer is a loop.Observer recording the spans of a run:
+//
+//	clancy.run          the whole run
+//	└─ clancy.step      an iteration, from the start of the agent to the next one
+//	   ├─ clancy.agent  the agent command
+//	   └─ clancy.verify the loop.verify command
+//
+// Its methods are called from the goroutine running the loop.
+type Tracer struct {
+	loop.NopObserver
+
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+	file     io.Closer // Trace file, when exporting to a file
+	attrs    []attribute.KeyValue
+
+	runCtx  context.Context
+	run     trace.Span
+	stepCtx context.Context
+	step    trace.Span
+	verify  trace.Span
+}
+
+var _ loop.Observer = (*Tracer)(nil)
+
+// New creates a Tracer exporting the spans of a run of cfg, loaded from
+// configPath, as set in cfg.Telemetry. runDir is the run directory, where
+// the trace file goes by default.
+func New(ctx context.Context, cfg *config.Config, configPath, runDir string) (*Tracer, error) {
+	t := &Tracer{
+		attrs: []attribute.KeyValue{
+			attribute.String("clancy.config", configPath),
+			attribute.String("clancy.agent.command", cfg.Agent.Command),
+		},
+	}
+
+	var exporter sdktrace.SpanExporter
+	if cfg.Telemetry.Endpoint != "" {
+		exp, err := otlptracehttp.New(ctx,
+			otlptracehttp.WithEndpointURL(tracesURL(cfg.Telemetry.Endpoint)),
+			otlptracehttp.WithHeaders(cfg.Telemetry.Headers),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the OTLP exporter: %w", err)
+		}
+		exporter = exp
+	} else {
+		path := cfg.Telemetry.File
+		if path == "" {
+			path = filepath.Join(runDir, DefaultFile)
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the trace file: %w", err)
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("failed to create the file exporter: %w", err)
+		}
+		exporter, t.file = exp, f
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(cfg.Telemetry.ServiceName),
+		semconv.ServiceVersion(version.Version),
+	)
+	t.provider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	t.tracer = t.provider.Tracer("github.com/eduardolat/clancy")
+	return t, nil
+}
+
+// tracesURL returns the URL spans are sent to. Like the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT, an endpoint without a path is the base URL of
+// the collector.
+func tracesURL(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || strings.Trim(u.Path, "/") != "" {
+		return endpoint
+	}
+	u.Path = "/v1/traces"
+	return u.String()
+}
+
+// Shutdown ends any open span and flushes the spans to the exporter.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.endStep()
+	if t.run != nil {
+		t.run.End()
+		t.run = nil
+	}
+
+	err := t.provider.Shutdown(ctx)
+	if t.file != nil {
+		if cerr := t.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// endStep ends the span of the current iteration, if any.
+func (t *Tracer) endStep() {
+	if t.verify != nil {
+		t.verify.End()
+		t.verify = nil
+	}
+	if t.step != nil {
+		t.step.End()
+		t.step = nil
+	}
+}
+
+func (t *Tracer) OnRunStart(info loop.RunInfo) {
+	attrs := append([]attribute.KeyValue{
+		attribute.String("clancy.run_id", info.RunID),
+		attribute.Int("clancy.first_step", info.FirstStep),
+		attribute.Int("clancy.max_steps", info.MaxSteps),
+		attribute.Int64("clancy.timeout_ms", info.Timeout.Milliseconds()),
+	}, t.attrs...)
+	t.runCtx, t.run = t.tracer.Start(context.Background(), "clancy.run", trace.WithAttributes(attrs...))
+}
+
+func (t *Tracer) OnStepStart(step int) {
+	if t.run == nil {
+		return
+	}
+	t.endStep()
+	t.stepCtx, t.step = t.tracer.Start(t.runCtx, "clancy.step", trace.WithAttributes(attribute.Int("clancy.step", step)))
+}
+
+func (t *Tracer) OnReload(step int, reload loop.Reload) {
+	t.runEvent("reloaded",
+		attribute.Int("clancy.step", step),
+		attribute.Bool("clancy.reload.prompt", reload.Prompt),
+		attribute.Bool("clancy.reload.command", reload.Command),
+		attribute.Bool("clancy.reload.env", reload.Env),
+	)
+}
+
+func (t *Tracer) OnStepEnd(res loop.StepResult, stopMatched bool) {
+	if t.step == nil {
+		return
+	}
+	_, agent := t.tracer.Start(t.stepCtx, "clancy.agent", trace.WithTimestamp(res.Started))
+	if res.Err != nil {
+		agent.RecordError(res.Err)
+		agent.SetStatus(codes.Error, res.Err.Error())
+	}
+	agent.End(trace.WithTimestamp(res.Started.Add(res.Duration)))
+
+	t.step.SetAttributes(
+		attribute.String("clancy.step.status", string(res.Status)),
+		attribute.Int("clancy.exit_code", res.ExitCode),
+		attribute.Bool("clancy.stop_matched", stopMatched),
+		attribute.Int("clancy.output_bytes", len(res.Output)),
+	)
+}
+
+func (t *Tracer) OnStepTimeout(step int, timeout time.Duration) {
+	t.event("step_timeout", attribute.Int64("clancy.timeout_ms", timeout.Milliseconds()))
+}
+
+func (t *Tracer) OnIdleTimeout(step int, timeout time.Duration) {
+	t.event("idle_timeout", attribute.Int64("clancy.timeout_ms", timeout.Milliseconds()))
+}
+
+func (t *Tracer) OnStepError(step int, err error) {
+	if t.step != nil {
+		t.step.SetStatus(codes.Error, err.Error())
+	}
+}
+
+func (t *Tracer) OnAbort(step int, phrase string) {
+	t.event("abort_phrase", attribute.String("clancy.phrase", phrase))
+}
+
+func (t *Tracer) OnNoProgress(step, steps int) {
+	t.event("no_progress", attribute.Int("clancy.unchanged_steps", steps))
+}
+
+func (t *Tracer) OnExitCode(step, code int, action string) {
+	t.event("exit_code_rule", attribute.Int("clancy.exit_code", code), attribute.String("clancy.action", action))
+}
+
+func (t *Tracer) OnVerify(step int, command string) {
+	if t.step == nil {
+		return
+	}
+	_, t.verify = t.tracer.Start(t.stepCtx, "clancy.verify", trace.WithAttributes(attribute.String("clancy.verify.command", command)))
+}
+
+func (t *Tracer) OnVerifyEnd(step int, err error) {
+	if t.verify == nil {
+		return
+	}
+	if err != nil {
+		t.verify.RecordError(err)
+		t.verify.SetStatus(codes.Error, err.Error())
+	}
+	t.verify.End()
+	t.verify = nil
+}
+
+func (t *Tracer) OnStopFound(step int) {
+	if t.step != nil {
+		t.step.SetAttributes(attribute.Bool("clancy.stop_found", true))
+	}
+}
+
+func (t *Tracer) OnCooldown(step int, delay time.Duration) {
+	if t.step != nil {
+		t.step.SetAttributes(
+			attribute.Int64("clancy.delay_ms", delay.Milliseconds()),
+			attribute.String("clancy.delay_reason", "delay"),
+		)
+	}
+}
+
+func (t *Tracer) OnBackoff(step, rule, attempt int, delay time.Duration) {
+	if t.step != nil {
+		t.step.SetAttributes(
+			attribute.Int64("clancy.delay_ms", delay.Milliseconds()),
+			attribute.String("clancy.delay_reason", "backoff"),
+			attribute.Int("clancy.backoff.rule", rule),
+			attribute.Int("clancy.backoff.attempt", attempt),
+		)
+	}
+}
+
+func (t *Tracer) OnPause(step int, frozen bool) {
+	t.runEvent("paused", attribute.Bool("clancy.timeout_frozen", frozen))
+}
+
+func (t *Tracer) OnResume(step int) {
+	t.runEvent("resumed")
+}
+
+func (t *Tracer) OnRunEnd(summary loop.RunSummary) {
+	if t.run == nil {
+		return
+	}
+	t.endStep()
+	t.run.SetAttributes(
+		attribute.String("clancy.reason", summary.Reason),
+		attribute.Int("clancy.steps", summary.Steps),
+	)
+	if summary.Err != nil {
+		t.run.SetStatus(codes.Error, summary.Err.Error())
+	}
+	t.run.End()
+	t.run = nil
+}
+
+// event adds an event to the span of the current iteration.
+func (t *Tracer) event(name string, attrs ...attribute.KeyValue) {
+	if t.step != nil {
+		t.step.AddEvent(name, trace.WithAttributes(attrs...))
+	}
+}
+
+// runEvent adds an event to the run span.
+func (t *Tracer) runEvent(name string, attrs ...attribute.KeyValue) {
+	if t.run != nil {
+		t.run.AddEvent(name, trace.WithAttributes(attrs...))
+	}
+}
@@ -0,0 +1,108 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eduardolat/clancy/internal/config"
+	"github.com/eduardolat/clancy/internal/loop"
+	"github.com/stretchr/testify/require"
+)
+
+// span holds the fields of the spans written by the file exporter that the
+// test checks.
+type span struct {
+	Name        string
+	SpanContext struct{ SpanID string }
+	Parent      struct{ SpanID string }
+	Attributes  []struct {
+		Key   string
+		Value struct{ Value any }
+	}
+	Status struct{ Code string }
+}
+
+func (s span) attr(key string) any {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value.Value
+		}
+	}
+	return nil
+}
+
+func readSpans(t *testing.T, path string) map[string][]span {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+
+	spans := map[string][]span{}
+	dec := json.NewDecoder(f)
+	for {
+		var s span
+		err := dec.Decode(&s)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		spans[s.Name] = append(spans[s.Name], s)
+	}
+	return spans
+}
+
+func TestTracer_File(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{
+		Agent:     config.AgentConfig{Command: "agent '${PROMPT}'"},
+		Telemetry: config.TelemetryConfig{Enabled: true, ServiceName: "clancy"},
+	}
+	tr, err := New(context.Background(), cfg, "clancy.yaml", dir)
+	require.NoError(t, err)
+
+	started := time.Now()
+	tr.OnRunStart(loop.RunInfo{RunID: "run-1", FirstStep: 1, MaxSteps: 3})
+	tr.OnStepStart(1)
+	tr.OnStepEnd(loop.StepResult{Step: 1, Status: loop.StepCompleted, ExitCode: 1, Output: "hello", Started: started, Duration: time.Second}, false)
+	tr.OnRetry(1)
+	tr.OnCooldown(1, 2*time.Second)
+	tr.OnStepStart(2)
+	tr.OnStepEnd(loop.StepResult{Step: 2, Status: loop.StepCompleted, Started: started, Duration: time.Second}, true)
+	tr.OnVerify(2, "go test ./...")
+	tr.OnVerifyEnd(2, errors.New("exit status 1"))
+	tr.OnRunEnd(loop.RunSummary{Reason: loop.ReasonMaxSteps, Err: errors.New("max steps reached"), Steps: 2})
+	require.NoError(t, tr.Shutdown(context.Background()))
+
+	spans := readSpans(t, filepath.Join(dir, DefaultFile))
+	require.Len(t, spans["clancy.run"], 1)
+	require.Len(t, spans["clancy.step"], 2)
+	require.Len(t, spans["clancy.agent"], 2)
+	require.Len(t, spans["clancy.verify"], 1)
+
+	run := spans["clancy.run"][0]
+	require.Equal(t, "run-1", run.attr("clancy.run_id"))
+	require.Equal(t, loop.ReasonMaxSteps, run.attr("clancy.reason"))
+	require.Equal(t, "Error", run.Status.Code)
+
+	// Steps are children of the run, the agent and verify spans of a step.
+	first, second := spans["clancy.step"][0], spans["clancy.step"][1]
+	require.Equal(t, run.SpanContext.SpanID, first.Parent.SpanID)
+	require.EqualValues(t, 1, first.attr("clancy.exit_code"))
+	require.EqualValues(t, 5, first.attr("clancy.output_bytes"))
+	require.EqualValues(t, 2000, first.attr("clancy.delay_ms"))
+	require.Equal(t, true, second.attr("clancy.stop_matched"))
+	require.Equal(t, second.SpanContext.SpanID, spans["clancy.verify"][0].Parent.SpanID)
+	require.Equal(t, "Error", spans["clancy.verify"][0].Status.Code)
+}
+
+func TestTracesURL(t *testing.T) {
+	require.Equal(t, "http://localhost:4318/v1/traces", tracesURL("http://localhost:4318"))
+	require.Equal(t, "http://localhost:4318/v1/traces", tracesURL("http://localhost:4318/"))
+	require.Equal(t, "https://otel.example.com/custom/traces", tracesURL("https://otel.example.com/custom/traces"))
+}
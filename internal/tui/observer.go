@@ -0,0 +1,156 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/eduardolat/clancy/internal/loop"
+)
+
+// Messages sent by the observer to the dashboard.
+type (
+	runStartMsg  loop.RunInfo
+	stepStartMsg struct{ step int }
+	outputMsg    struct {
+		step int
+		data string
+	}
+	stepEndMsg struct {
+		res         loop.StepResult
+		stopMatched bool
+	}
+	waitMsg struct {
+		label string
+		until time.Time
+	}
+	pauseMsg  struct{ paused bool }
+	noticeMsg string
+	runEndMsg loop.RunSummary
+)
+
+// outputInterval is how often the agent output is sent to the dashboard,
+// which also bounds how often it is rendered.
+const outputInterval = 100 * time.Millisecond
+
+// observer forwards loop notifications to the dashboard as messages. The
+// agent output is batched: OnStepOutput is called by the runner reading the
+// agent, which must not wait for the dashboard.
+type observer struct {
+	loop.NopObserver
+	p *tea.Program
+
+	mu      sync.Mutex
+	step    int
+	pending strings.Builder // Output not sent yet
+
+	sendMu sync.Mutex // Keeps batches in order with the other messages
+}
+
+var _ loop.Observer = (*observer)(nil)
+
+// run sends the batched output every outputInterval until done is closed.
+func (o *observer) run(done <-chan struct{}) {
+	ticker := time.NewTicker(outputInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			o.flush()
+		}
+	}
+}
+
+// flush sends the output batched so far, if any.
+func (o *observer) flush() {
+	o.sendMu.Lock()
+	defer o.sendMu.Unlock()
+	o.flushLocked()
+}
+
+func (o *observer) flushLocked() {
+	o.mu.Lock()
+	step, data := o.step, o.pending.String()
+	o.pending.Reset()
+	o.mu.Unlock()
+
+	if data != "" {
+		o.p.Send(outputMsg{step: step, data: data})
+	}
+}
+
+// send delivers msg after the output batched so far.
+func (o *observer) send(msg tea.Msg) {
+	o.sendMu.Lock()
+	defer o.sendMu.Unlock()
+	o.flushLocked()
+	o.p.Send(msg)
+}
+
+func (o *observer) OnRunStart(info loop.RunInfo) {
+	o.send(runStartMsg(info))
+}
+
+func (o *observer) OnReload(step int, reload loop.Reload) {
+	o.send(noticeMsg(fmt.Sprintf("Reloaded for step %02d: %s", step, reload)))
+}
+
+func (o *observer) OnStepStart(step int) {
+	o.send(stepStartMsg{step: step})
+}
+
+func (o *observer) OnStepOutput(step int, data []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.pending.Len() > maxOutput {
+		// The dashboard only keeps the end anyway.
+		rest := o.pending.String()[o.pending.Len()-maxOutput/2:]
+		o.pending.Reset()
+		o.pending.WriteString(rest)
+	}
+	o.step = step
+	o.pending.Write(data)
+}
+
+func (o *observer) OnStepEnd(res loop.StepResult, stopMatched bool) {
+	res.Output = "" // Already streamed, and possibly large
+	o.send(stepEndMsg{res: res, stopMatched: stopMatched})
+}
+
+func (o *observer) OnVerify(step int, command string) {
+	o.send(noticeMsg(fmt.Sprintf("Verifying step %02d: %s", step, command)))
+}
+
+func (o *observer) OnVerifyEnd(step int, err error) {
+	if err != nil {
+		o.send(noticeMsg(fmt.Sprintf("Verification of step %02d failed: %v", step, err)))
+	}
+}
+
+func (o *observer) OnCooldown(step int, delay time.Duration) {
+	o.send(waitMsg{label: "delay", until: time.Now().Add(delay)})
+}
+
+func (o *observer) OnBackoff(step, rule, attempt int, delay time.Duration) {
+	o.send(waitMsg{label: fmt.Sprintf("backoff rule %d", rule), until: time.Now().Add(delay)})
+}
+
+func (o *observer) OnPause(step int, frozen bool) {
+	o.send(pauseMsg{paused: true})
+}
+
+func (o *observer) OnResume(step int) {
+	o.send(pauseMsg{paused: false})
+}
+
+func (o *observer) OnWarning(err error) {
+	o.send(noticeMsg("Warning: " + err.Error()))
+}
+
+func (o *observer) OnRunEnd(summary loop.RunSummary) {
+	o.send(runEndMsg(summary))
+}
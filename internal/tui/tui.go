@@ -0,0 +1,441 @@
+// Package tui implements the full-screen dashboard enabled with --tui: the
+// live agent output in a scrollable pane, and a side panel with the progress
+// of the run.
+package tui
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/eduardolat/clancy/internal/ansi"
+	"github.com/eduardolat/clancy/internal/loop"
+	"github.com/eduardolat/clancy/internal/runs"
+)
+
+const (
+	// sideWidth is the width of the side panel, borders included.
+	sideWidth = 40
+
+	// maxOutput caps the live output kept in memory. The full transcript
+	// is still written to the run directory.
+	maxOutput = 256 * 1024
+
+	// diffTimeout bounds the git call refreshing the diff stat.
+	diffTimeout = 5 * time.Second
+)
+
+var (
+	paneStyle   = lipgloss.NewStyle().Border(lipgloss.RoundedBorder()).BorderForeground(lipgloss.Color("6"))
+	titleStyle  = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("6"))
+	labelStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	okStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("2"))
+	warnStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("3"))
+	failStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("1"))
+	selectStyle = lipgloss.NewStyle().Reverse(true)
+)
+
+// Options configures the dashboard.
+type Options struct {
+	Control *loop.Control
+	Stop    func()    // Ends the loop after the current step
+	Kill    func()    // Stops the agent right away
+	Run     *runs.Run // Source of the transcripts of earlier steps
+}
+
+// Program is a running dashboard.
+type Program struct {
+	p   *tea.Program
+	obs *observer
+}
+
+// New creates the dashboard. Pass Observer to loop.Run and call Run to show
+// it.
+func New(opts Options) *Program {
+	m := newModel(opts)
+	p := tea.NewProgram(m, tea.WithAltScreen())
+	return &Program{p: p, obs: &observer{p: p}}
+}
+
+// Observer returns the loop observer feeding the dashboard.
+func (p *Program) Observer() loop.Observer {
+	return p.obs
+}
+
+// Run shows the dashboard until the user quits.
+func (p *Program) Run() error {
+	done := make(chan struct{})
+	defer close(done)
+	go p.obs.run(done)
+
+	_, err := p.p.Run()
+	return err
+}
+
+// stepRow is a finished step in the side panel.
+type stepRow struct {
+	step     int
+	attempt  int
+	status   loop.StepStatus
+	exitCode int
+	duration time.Duration
+	stop     bool
+}
+
+type diffStatMsg string
+type tickMsg time.Time
+
+type model struct {
+	opts Options
+
+	width, height int
+	output        viewport.Model
+	live          strings.Builder // Raw output of the current step
+	viewing       int             // Index of the step shown, -1 for the live output
+	transcript    string
+
+	info     loop.RunInfo
+	start    time.Time
+	step     int
+	rows     []stepRow
+	selected int
+	attempts map[int]int
+	diffStat string
+	notice   string
+
+	paused    bool
+	pausing   bool // Pause requested, effective before the next step
+	waiting   string
+	waitUntil time.Time
+	stopping  bool
+	summary   *loop.RunSummary
+}
+
+func newModel(opts Options) *model {
+	m := &model{
+		opts:     opts,
+		output:   viewport.New(0, 0),
+		viewing:  -1,
+		start:    time.Now(),
+		attempts: map[int]int{},
+		diffStat: "…",
+	}
+
+	// Steps of a resumed run are known from its state.
+	if opts.Run != nil {
+		for _, rec := range opts.Run.State.Steps {
+			m.addRow(rec.Step, loop.StepStatus(rec.Status), rec.ExitCode, time.Duration(rec.Duration), false)
+		}
+	}
+	return m
+}
+
+func (m *model) addRow(step int, status loop.StepStatus, exitCode int, d time.Duration, stop bool) {
+	m.attempts[step]++
+	m.rows = append(m.rows, stepRow{step: step, attempt: m.attempts[step], status: status, exitCode: exitCode, duration: d, stop: stop})
+	m.selected = len(m.rows) - 1
+}
+
+func (m *model) Init() tea.Cmd {
+	return tea.Batch(tick(), diffStat())
+}
+
+func tick() tea.Cmd {
+	return tea.Tick(time.Second, func(t time.Time) tea.Msg { return tickMsg(t) })
+}
+
+// diffStat summarizes the uncommitted changes in the working directory.
+func diffStat() tea.Cmd {
+	return func() tea.Msg {
+		ctx, cancel := context.WithTimeout(context.Background(), diffTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, "git", "diff", "--shortstat").Output()
+		switch {
+		case err != nil:
+			return diffStatMsg("not a git repository")
+		case len(strings.TrimSpace(string(out))) == 0:
+			return diffStatMsg("no changes")
+		default:
+			return diffStatMsg(strings.TrimSpace(string(out)))
+		}
+	}
+}
+
+func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		m.output.Width = max(m.width-sideWidth-2, 10)
+		m.output.Height = max(m.height-4, 3)
+		m.refresh()
+
+	case tea.KeyMsg:
+		return m, m.handleKey(msg)
+
+	case tickMsg:
+		return m, tick()
+
+	case diffStatMsg:
+		m.diffStat = string(msg)
+
+	case runStartMsg:
+		m.info = loop.RunInfo(msg)
+		m.start = time.Now()
+
+	case stepStartMsg:
+		m.step = msg.step
+		m.waiting = ""
+		m.live.Reset()
+		m.refresh()
+
+	case outputMsg:
+		m.live.WriteString(msg.data)
+		if m.live.Len() > maxOutput {
+			s := m.live.String()
+			m.live.Reset()
+			m.live.WriteString(s[len(s)-maxOutput/2:])
+		}
+		if m.viewing < 0 {
+			m.refresh()
+		}
+
+	case stepEndMsg:
+		m.addRow(msg.res.Step, msg.res.Status, msg.res.ExitCode, msg.res.Duration, msg.stopMatched)
+		return m, diffStat()
+
+	case waitMsg:
+		m.waiting, m.waitUntil = msg.label, msg.until
+
+	case pauseMsg:
+		m.paused, m.pausing = msg.paused, false
+
+	case noticeMsg:
+		m.notice = string(msg)
+
+	case runEndMsg:
+		summary := loop.RunSummary(msg)
+		m.summary = &summary
+		m.waiting = ""
+		return m, diffStat()
+	}
+	return m, nil
+}
+
+func (m *model) handleKey(msg tea.KeyMsg) tea.Cmd {
+	switch msg.String() {
+	case "q", "a", "ctrl+c":
+		if m.summary != nil {
+			return tea.Quit
+		}
+		return m.abort()
+	case "p":
+		switch {
+		case m.paused || m.pausing:
+			m.opts.Control.Resume()
+			m.pausing = false
+		default:
+			m.opts.Control.Pause()
+			m.pausing = true
+		}
+	case "s":
+		if m.opts.Control.SkipDelay() {
+			m.waiting = ""
+		}
+	case "up", "k":
+		m.selected = max(m.selected-1, 0)
+	case "down", "j":
+		m.selected = min(m.selected+1, len(m.rows)-1)
+	case "enter", "t":
+		if m.selected >= 0 && m.selected < len(m.rows) {
+			m.viewing = m.selected
+			m.transcript = m.readTranscript(m.rows[m.selected])
+			m.refresh()
+			m.output.GotoTop()
+		}
+	case "esc", "l":
+		m.viewing = -1
+		m.refresh()
+	case "pgup", "b":
+		m.output.PageUp()
+	case "pgdown", "f", " ":
+		m.output.PageDown()
+	case "home", "g":
+		m.output.GotoTop()
+	case "end", "G":
+		m.output.GotoBottom()
+	}
+	return nil
+}
+
+// abort stops the loop after the current step. A second request kills the
+// agent right away.
+func (m *model) abort() tea.Cmd {
+	if !m.stopping {
+		m.stopping = true
+		m.notice = "Stopping after the current step. Press a again to kill the agent."
+		m.opts.Stop()
+		return nil
+	}
+	m.notice = "Killing the agent."
+	m.opts.Kill()
+	return nil
+}
+
+// readTranscript loads the output of a finished step from the run directory.
+func (m *model) readTranscript(row stepRow) string {
+	if m.opts.Run == nil {
+		return "Transcripts are only available for persisted runs."
+	}
+	path := filepath.Join(m.opts.Run.Dir, runs.StepName(row.step, row.attempt)+".txt")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Sprintf("Cannot read the transcript: %v", err)
+	}
+	return string(data)
+}
+
+// refresh puts the output being viewed into the pane, following the end of
+// the live output unless the user scrolled up.
+func (m *model) refresh() {
+	follow := m.output.AtBottom()
+	text := m.transcript
+	if m.viewing < 0 {
+		text = clean(m.live.String())
+	}
+	m.output.SetContent(lipgloss.NewStyle().Width(m.output.Width).Render(text))
+	if m.viewing < 0 && follow {
+		m.output.GotoBottom()
+	}
+}
+
+// clean makes raw terminal output displayable in the pane: escapes are
+// removed and carriage returns, used by spinners and progress bars, keep
+// only the text written last.
+func clean(s string) string {
+	lines := strings.Split(ansi.Strip(s), "\n")
+	for i, line := range lines {
+		if j := strings.LastIndexByte(line, '\r'); j >= 0 {
+			lines[i] = line[j+1:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (m *model) View() string {
+	if m.width == 0 {
+		return "Starting Clancy…"
+	}
+
+	title := fmt.Sprintf(" Live output · step %02d ", m.step)
+	if m.viewing >= 0 {
+		row := m.rows[m.viewing]
+		title = fmt.Sprintf(" Transcript · step %02d (attempt %d) · esc for live output ", row.step, row.attempt)
+	}
+	left := paneStyle.Width(m.output.Width).Height(m.output.Height + 1).
+		Render(titleStyle.Render(title) + "\n" + m.output.View())
+	right := paneStyle.Width(sideWidth - 2).Height(m.output.Height + 1).
+		Render(m.side())
+
+	footer := labelStyle.Render(" p pause/resume · s skip delay · a abort · ↑/↓ select step · enter transcript · esc live · pgup/pgdn scroll · q quit")
+	if m.notice != "" {
+		footer = warnStyle.Render(" "+m.notice) + "\n" + footer
+	} else {
+		footer = "\n" + footer
+	}
+	return lipgloss.JoinHorizontal(lipgloss.Top, left, right) + "\n" + footer
+}
+
+// side renders the side panel.
+func (m *model) side() string {
+	var b strings.Builder
+	field := func(label, value string) {
+		fmt.Fprintf(&b, "%s %s\n", labelStyle.Render(fmt.Sprintf("%-12s", label)), value)
+	}
+
+	b.WriteString(titleStyle.Render("🍩 Clancy") + "\n")
+	if m.info.RunID != "" {
+		field("Run", m.info.RunID)
+	}
+	field("Step", fmt.Sprintf("%02d/%02d", m.step, m.info.MaxSteps))
+
+	elapsed := time.Since(m.start).Round(time.Second)
+	if m.info.Timeout > 0 {
+		field("Elapsed", fmt.Sprintf("%s / %s", elapsed, m.info.Timeout.Round(time.Second)))
+	} else {
+		field("Elapsed", elapsed.String())
+	}
+	field("Status", m.status())
+
+	stop := labelStyle.Render("no step yet")
+	if n := len(m.rows); n > 0 {
+		if m.rows[n-1].stop {
+			stop = okStyle.Render("found")
+		} else {
+			stop = warnStyle.Render("not found")
+		}
+	}
+	field("Stop phrase", stop)
+
+	b.WriteString("\n" + titleStyle.Render("Steps") + "\n")
+	// Show the rows around the selection that fit in the panel.
+	room := max(m.output.Height-14, 3)
+	first := max(min(m.selected-room/2, len(m.rows)-room), 0)
+	for i := first; i < len(m.rows) && i < first+room; i++ {
+		line := rowLine(m.rows[i])
+		if i == m.selected {
+			line = selectStyle.Render(line)
+		}
+		b.WriteString(line + "\n")
+	}
+
+	b.WriteString("\n" + titleStyle.Render("Git") + "\n")
+	b.WriteString(lipgloss.NewStyle().Width(sideWidth - 4).Render(m.diffStat))
+	return b.String()
+}
+
+func (m *model) status() string {
+	switch {
+	case m.summary != nil:
+		style := failStyle
+		if m.summary.Reason == loop.ReasonSuccess {
+			style = okStyle
+		}
+		return style.Render("done: " + m.summary.Reason)
+	case m.paused:
+		return warnStyle.Render("paused")
+	case m.stopping:
+		return warnStyle.Render("stopping")
+	case m.waiting != "":
+		left := max(time.Until(m.waitUntil), 0).Round(time.Second)
+		return warnStyle.Render(fmt.Sprintf("%s, %s left", m.waiting, left))
+	case m.pausing:
+		return warnStyle.Render("pausing after step")
+	default:
+		return okStyle.Render("running")
+	}
+}
+
+// rowLine formats a finished step, e.g. "✓ 03   1m02s exit 0".
+func rowLine(row stepRow) string {
+	mark := "·"
+	switch {
+	case row.stop:
+		mark = "✓"
+	case row.status != loop.StepCompleted:
+		mark = "⏰"
+	case row.exitCode != 0:
+		mark = "✗"
+	}
+	name := fmt.Sprintf("%02d", row.step)
+	if row.attempt > 1 {
+		name += fmt.Sprintf("-%d", row.attempt)
+	}
+	return fmt.Sprintf("%s %-5s %7s exit %d", mark, name, row.duration.Round(time.Second), row.exitCode)
+}
@@ -0,0 +1,114 @@
+package tui
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/eduardolat/clancy/internal/loop"
+	"github.com/eduardolat/clancy/internal/runs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClean(t *testing.T) {
+	require.Equal(t, "done 100%\nnext", clean("\x1b[32mdone\x1b[0m 10%\rdone 100%\nnext"))
+	require.Equal(t, "", clean(""))
+}
+
+func TestModel(t *testing.T) {
+	dir := t.TempDir()
+	run := &runs.Run{Dir: dir}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "step-01.txt"), []byte("first transcript"), 0644))
+
+	ctrl := loop.NewControl()
+	var stopped, killed int
+	m := newModel(Options{
+		Control: ctrl,
+		Stop:    func() { stopped++ },
+		Kill:    func() { killed++ },
+		Run:     run,
+	})
+	key := func(s string) tea.Cmd {
+		_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(s)})
+		return cmd
+	}
+
+	m.Update(tea.WindowSizeMsg{Width: 120, Height: 30})
+	m.Update(runStartMsg(loop.RunInfo{RunID: "run-1", FirstStep: 1, MaxSteps: 5, Timeout: time.Hour}))
+	m.Update(stepStartMsg{step: 1})
+	m.Update(outputMsg{step: 1, data: "working\r"})
+	m.Update(outputMsg{step: 1, data: "hello from the agent\n"})
+	m.Update(stepEndMsg{res: loop.StepResult{Step: 1, Status: loop.StepCompleted, Duration: 2 * time.Second}})
+	m.Update(stepStartMsg{step: 2})
+	m.Update(outputMsg{step: 2, data: "second step\n"})
+
+	view := m.View()
+	require.Contains(t, view, "second step")
+	require.Contains(t, view, "02/05")
+	require.Contains(t, view, "run-1")
+	require.Contains(t, view, "not found")
+
+	// Pause takes effect before the next step, a second press cancels it.
+	key("p")
+	require.Contains(t, m.View(), "pausing after step")
+	require.True(t, ctrl.Paused())
+	key("p")
+	require.False(t, ctrl.Paused())
+
+	// Open the transcript of the selected step, then go back to the live output.
+	key("t")
+	require.Contains(t, m.View(), "first transcript")
+	_, _ = m.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	require.Contains(t, m.View(), "second step")
+
+	// Abort asks to stop first, then kills the agent.
+	require.Nil(t, key("a"))
+	require.Equal(t, 1, stopped)
+	key("a")
+	require.Equal(t, 1, killed)
+
+	// Once the run ended, q quits.
+	m.Update(runEndMsg(loop.RunSummary{Reason: loop.ReasonInterrupted}))
+	require.Contains(t, m.View(), "done: interrupted")
+	require.NotNil(t, key("q"))
+}
+
+// recorder is a tea.Model recording the messages it receives.
+type recorder struct {
+	msgs chan tea.Msg
+}
+
+func (r recorder) Init() tea.Cmd { return nil }
+
+func (r recorder) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg.(type) {
+	case outputMsg, stepEndMsg:
+		r.msgs <- msg
+	}
+	return r, nil
+}
+
+func (r recorder) View() string { return "" }
+
+func TestObserver_BatchesOutput(t *testing.T) {
+	rec := recorder{msgs: make(chan tea.Msg, 10)}
+	p := tea.NewProgram(rec, tea.WithInput(nil), tea.WithOutput(io.Discard), tea.WithoutRenderer())
+	obs := &observer{p: p}
+
+	// The runner is never blocked, even before the dashboard runs.
+	for range 1000 {
+		obs.OnStepOutput(1, []byte("x"))
+	}
+
+	go func() { _, _ = p.Run() }()
+	defer p.Kill()
+
+	// The output comes in one batch, before the end of the step.
+	obs.OnStepEnd(loop.StepResult{Step: 1}, false)
+	require.Equal(t, outputMsg{step: 1, data: strings.Repeat("x", 1000)}, <-rec.msgs)
+	require.IsType(t, stepEndMsg{}, <-rec.msgs)
+}